@@ -0,0 +1,129 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"math"
+	"time"
+)
+
+// Opaque data of PINGs which measure the bandwidth-delay product.
+const kBdpPingData uint64 = 0x42445050494e47
+
+// Greatest number of doublings of the delay between samples which don't
+// grow windows, as round trips. The delay is thereby at most 64 RTTs.
+const kMaxBdpBackoff = 6
+
+// Estimates the bandwidth-delay products of recieved DATA, of the
+// connection and of its busiest stream, as the greatest rates at which
+// the application has consumed DATA times the least PING round trip.
+// Enabled by Config.MaxRecieveWindow.
+type bdpEstimator struct {
+	pinging bool      // A PING is outstanding.
+	sentAt  time.Time // When the PING was queued.
+	// Bytes consumed since the PING was sent, on the connection
+	// and by stream.
+	sample        int
+	streamSamples map[StreamID]int
+
+	// Least round trip, and greatest rates of consumption (in bytes
+	// per second) of the connection and of any one stream.
+	minRtt                 time.Duration
+	maxRate, maxStreamRate float64
+
+	// Consecutive samples which didn't grow a window. Each doubles the
+	// delay (in round trips) before the next sample begins.
+	idleSamples int
+	nextSample  time.Time
+}
+
+// Accounts for n bytes consumed from the stream. If no PING is
+// outstanding and windows may yet grow, one is sent to begin a sample.
+func (c *connection) sampleBdp(id StreamID, n int) {
+	max := c.config.MaxRecieveWindow
+	if max == 0 || c.goAwaySent {
+		return
+	} else if b := &c.bdp; b.pinging {
+		b.sample += n
+		b.streamSamples[id] += n
+		return
+	}
+	if c.recvFlow.WinSize >= max &&
+		int(c.localSettings[SETTINGS_INITIAL_WINDOW_SIZE]) >= max {
+		return
+	}
+	if now := c.clock.Now(); !now.Before(c.bdp.nextSample) {
+		c.bdp.pinging, c.bdp.sentAt = true, now
+		c.bdp.sample, c.bdp.streamSamples = 0, make(map[StreamID]int)
+		c.writeQueue.enqueueFront(&PingFrame{OpaqueData: kBdpPingData})
+	}
+}
+
+// Completes a sample on the PING's ACK. If most of a window could be
+// consumed within the round trip, the window limits throughput, and is
+// grown to twice the estimate (but no more than the maximum). Streams
+// grow through SETTINGS_INITIAL_WINDOW_SIZE, which also sizes streams
+// opened thereafter.
+func (c *connection) tuneRecieveWindows() {
+	b, now := &c.bdp, c.clock.Now()
+	b.pinging = false
+
+	rtt := now.Sub(b.sentAt)
+	if rtt <= 0 {
+		rtt = time.Nanosecond // Below the clock's resolution.
+	}
+	if b.minRtt == 0 || rtt < b.minRtt {
+		b.minRtt = rtt
+	}
+	streamSample := 0
+	for _, n := range b.streamSamples {
+		if n > streamSample {
+			streamSample = n
+		}
+	}
+	b.maxRate = math.Max(b.maxRate, float64(b.sample)/rtt.Seconds())
+	b.maxStreamRate = math.Max(b.maxStreamRate,
+		float64(streamSample)/rtt.Seconds())
+
+	grew := false
+	if target, ok := c.bdpTarget(b.maxRate, c.recvFlow.WinSize); ok {
+		if delta := c.recvFlow.Grow(target); delta != 0 {
+			c.writeQueue.enqueueFront(
+				&WindowUpdateFrame{SizeDelta: uint32(delta)})
+			grew = true
+		}
+	}
+	window := int(c.localSettings[SETTINGS_INITIAL_WINDOW_SIZE])
+	if target, ok := c.bdpTarget(b.maxStreamRate, window); ok &&
+		target > window {
+		c.writeQueue.enqueueFront(&SettingsFrame{
+			Settings: map[SettingID]uint32{
+				SETTINGS_INITIAL_WINDOW_SIZE: uint32(target)}})
+		grew = true
+	}
+
+	if grew {
+		b.idleSamples, b.nextSample = 0, time.Time{}
+	} else {
+		if b.idleSamples < kMaxBdpBackoff {
+			b.idleSamples++
+		}
+		b.nextSample = now.Add(b.minRtt << b.idleSamples)
+	}
+}
+
+// Returns the window size for a consumption rate, if the window limits
+// throughput: if the rate over the least round trip is two-thirds or
+// more of the current window.
+func (c *connection) bdpTarget(rate float64, window int) (int, bool) {
+	bdp := int(math.Round(rate * c.bdp.minRtt.Seconds()))
+	if bdp*3 < window*2 {
+		return 0, false
+	}
+	target := 2 * bdp
+	if target > c.config.MaxRecieveWindow {
+		target = c.config.MaxRecieveWindow
+	}
+	return target, true
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Recieves and consumes n bytes of DATA on stream 1.
+func (t *ConnectionTest) recieveAndConsume(n int) {
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, n),
+	}
+	t.handle.consume(1, n)
+}
+
+// Expects n sent frames, which are returned by type.
+func (t *ConnectionTest) expectSentFrames(c *gc.C, n int) map[FrameType]Frame {
+	sent := make(map[FrameType]Frame)
+	for i := 0; i != n; i++ {
+		frame := t.expectSent(c)
+		sent[frame.GetType()] = frame
+	}
+	return sent
+}
+
+func (t *ConnectionTest) TestRecieveWindowAutoTuning(c *gc.C) {
+	t.conn.config.MaxRecieveWindow = 80000
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+
+	// Consumption begins a sample.
+	t.recieveAndConsume(10000)
+	ping := t.expectSent(c).(*PingFrame)
+	c.Check(ping.OpaqueData, gc.Equals, kBdpPingData)
+
+	// Most of the window is consumed within the round trip.
+	t.recieveAndConsume(50000)
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &WindowUpdateFrame{})
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &WindowUpdateFrame{})
+	t.recvMux <- &PingFrame{
+		FramePrefix: FramePrefix{Flags: ACK},
+		OpaqueData:  kBdpPingData,
+	}
+
+	// Windows grow to twice the sample, bounded by the maximum.
+	sent := t.expectSentFrames(c, 2)
+	update := sent[WINDOW_UPDATE].(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(0))
+	c.Check(update.SizeDelta, gc.Equals, uint32(80000-65535))
+	c.Check(sent[SETTINGS].(*SettingsFrame).Settings, gc.DeepEquals,
+		map[SettingID]uint32{SETTINGS_INITIAL_WINDOW_SIZE: 80000})
+
+	t.syncLoop(c)
+	c.Check(t.conn.recvFlow.WinSize, gc.Equals, 80000)
+	c.Check(t.conn.streams[1].RecvFlow.WinSize, gc.Equals, 80000)
+
+	// Windows are at their maximum, and aren't further sampled.
+	t.recieveAndConsume(10)
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c).(*PingFrame).OpaqueData, gc.Equals, uint64(0))
+}
+
+func (t *ConnectionTest) TestRecieveWindowSufficesForSlowConsumer(c *gc.C) {
+	clock := newFakeClock()
+	t.conn.clock = clock
+	t.conn.config.MaxRecieveWindow = 1 << 20
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+
+	t.recieveAndConsume(100)
+	c.Check(t.expectSent(c).(*PingFrame).OpaqueData, gc.Equals, kBdpPingData)
+	t.recieveAndConsume(1000)
+	clock.Advance(10 * time.Millisecond)
+	t.recvMux <- &PingFrame{
+		FramePrefix: FramePrefix{Flags: ACK},
+		OpaqueData:  kBdpPingData,
+	}
+
+	// Little of the window was consumed, and it isn't grown. The next
+	// sample waits two round trips.
+	t.recieveAndConsume(100)
+	t.syncLoop(c)
+	c.Check(t.conn.bdp.pinging, gc.Equals, false)
+	c.Check(t.conn.recvFlow.WinSize, gc.Equals, 65535)
+
+	clock.Advance(20 * time.Millisecond)
+	t.recieveAndConsume(100)
+	c.Check(t.expectSent(c).(*PingFrame).OpaqueData, gc.Equals, kBdpPingData)
+	clock.Advance(10 * time.Millisecond)
+	t.recvMux <- &PingFrame{
+		FramePrefix: FramePrefix{Flags: ACK},
+		OpaqueData:  kBdpPingData,
+	}
+
+	// Then four round trips, and so on.
+	t.syncLoop(c)
+	c.Check(t.conn.bdp.nextSample, gc.Equals,
+		clock.Now().Add(40*time.Millisecond))
+}
+
+func (t *ConnectionTest) TestStreamWindowSampledPerStream(c *gc.C) {
+	clock := newFakeClock()
+	t.conn.clock = clock
+	t.conn.config.MaxRecieveWindow = 1 << 20
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3}}
+
+	t.recieveAndConsume(100)
+	c.Check(t.expectSent(c).(*PingFrame).OpaqueData, gc.Equals, kBdpPingData)
+
+	// Streams together consume most of the connection window within the
+	// round trip, but neither consumes most of its own.
+	for _, id := range []StreamID{1, 3} {
+		t.recvMux <- &DataFrame{
+			FramePrefix: FramePrefix{StreamID: id},
+			Data:        make([]byte, 30000),
+		}
+		t.handle.consume(id, 30000)
+	}
+	c.Check(t.expectSent(c).(*WindowUpdateFrame).StreamID, gc.Equals,
+		StreamID(0))
+	clock.Advance(10 * time.Millisecond)
+	t.recvMux <- &PingFrame{
+		FramePrefix: FramePrefix{Flags: ACK},
+		OpaqueData:  kBdpPingData,
+	}
+
+	// Only the connection window grows.
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(0))
+	c.Check(update.SizeDelta, gc.Equals, uint32(120000-65535))
+	t.syncLoop(c)
+	c.Check(t.conn.recvFlow.WinSize, gc.Equals, 120000)
+	c.Check(t.conn.localSettings[SETTINGS_INITIAL_WINDOW_SIZE],
+		gc.Equals, uint32(65535))
+}
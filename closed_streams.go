@@ -0,0 +1,59 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+// Default number of closed streams for which state is retained.
+const kClosedStreamRetention = 128
+
+// Bounded record of the final states of closed streams. Retained so that
+// frames arriving after a stream closes are correctly classified (eg, as
+// ignorable following a sent RST_STREAM). Once capacity is reached, the
+// earliest closed stream is evicted.
+type closedStreams struct {
+	capacity int
+
+	states map[StreamID]StreamState
+	order  []StreamID // Retained streams, in order of closing.
+
+	// Largest StreamID which has been evicted. Streams at or below it
+	// which aren't retained may have been closed and since evicted.
+	maxEvicted StreamID
+}
+
+func (r *closedStreams) add(id StreamID, state StreamState) {
+	if _, ok := r.states[id]; ok {
+		r.states[id] = state
+		return
+	}
+	if r.capacity <= 0 {
+		r.noteEvicted(id)
+		return
+	}
+	if len(r.order) == r.capacity {
+		delete(r.states, r.order[0])
+		r.noteEvicted(r.order[0])
+		r.order = r.order[1:]
+	}
+	if r.states == nil {
+		r.states = make(map[StreamID]StreamState)
+	}
+	r.states[id] = state
+	r.order = append(r.order, id)
+}
+
+func (r *closedStreams) noteEvicted(id StreamID) {
+	if id > r.maxEvicted {
+		r.maxEvicted = id
+	}
+}
+
+func (r *closedStreams) lookup(id StreamID) (StreamState, bool) {
+	state, ok := r.states[id]
+	return state, ok
+}
+
+// Whether the stream may have been closed and evicted.
+func (r *closedStreams) mayHaveEvicted(id StreamID) bool {
+	return id <= r.maxEvicted
+}
@@ -0,0 +1,55 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+type ClosedStreamsTest struct{}
+
+func (t *ClosedStreamsTest) TestEvictsInOrderOfClosing(c *gc.C) {
+	record := closedStreams{capacity: 2}
+
+	record.add(5, Closed)
+	record.add(3, ClosedWithSentReset)
+	c.Check(record.mayHaveEvicted(5), gc.Equals, false)
+
+	record.add(1, Closed)
+
+	_, ok := record.lookup(5)
+	c.Check(ok, gc.Equals, false)
+	state, ok := record.lookup(3)
+	c.Check(ok, gc.Equals, true)
+	c.Check(state, gc.Equals, ClosedWithSentReset)
+	state, ok = record.lookup(1)
+	c.Check(ok, gc.Equals, true)
+	c.Check(state, gc.Equals, Closed)
+
+	c.Check(record.mayHaveEvicted(5), gc.Equals, true)
+	c.Check(record.mayHaveEvicted(7), gc.Equals, false)
+	c.Check(record.order, gc.HasLen, 2)
+}
+
+func (t *ClosedStreamsTest) TestReAddUpdatesState(c *gc.C) {
+	record := closedStreams{capacity: 2}
+
+	record.add(1, Closed)
+	record.add(1, ClosedWithSentReset)
+	c.Check(record.order, gc.HasLen, 1)
+
+	state, _ := record.lookup(1)
+	c.Check(state, gc.Equals, ClosedWithSentReset)
+}
+
+func (t *ClosedStreamsTest) TestZeroCapacity(c *gc.C) {
+	record := closedStreams{}
+
+	record.add(3, Closed)
+	_, ok := record.lookup(3)
+	c.Check(ok, gc.Equals, false)
+	c.Check(record.mayHaveEvicted(3), gc.Equals, true)
+}
+
+var _ = gc.Suite(&ClosedStreamsTest{})
@@ -0,0 +1,179 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"fmt"
+	"log"
+)
+
+// Configuration of a Connection. Fields which are left zero take their
+// defaults. A Config may be shared by many connections, each of which
+// may apply ConfigOverrides to its own copy.
+type Config struct {
+	// Local SETTINGS, sent to the peer as the connection starts.
+	// Settings which aren't present take their protocol defaults.
+	// SETTINGS_INITIAL_WINDOW_SIZE is the initial receive window of each
+	// stream, which StreamHandle.SetRecieveWindow() may enlarge.
+	Settings map[SettingID]uint32
+
+	// Size of the connection receive window. Defaults to (and may not be
+	// less than) the protocol's initial window of 65,535 bytes. A larger
+	// window is advertised to the peer through WINDOW_UPDATE.
+	ConnectionWindowSize int
+
+	// Bound of recieve windows grown by auto-tuning. If set, the
+	// bandwidth-delay product of recieved DATA is estimated through
+	// PINGs, and the connection and stream windows are grown until they
+	// sustain the rate at which DATA is consumed. Zero disables tuning.
+	MaxRecieveWindow int
+
+	// Maximum payload of sent DATA frames. Defaults to the
+	// largest which the frame format allows.
+	MaxDataPayload int
+
+	// Policy choosing the padding of sent DATA and HEADERS frames which
+	// aren't already padded. DATA padding is chosen as DATA is sent, from
+	// the length of its content after any split by flow control, and is
+	// charged to flow control. HEADERS padding is chosen by FrameWriter,
+	// from the encoded length of the header block. Defaults to NoPadding.
+	Padding PaddingPolicy
+
+	// Number of closed streams whose final states are retained.
+	// Defaults to kClosedStreamRetention.
+	ClosedStreamRetention int
+
+	// Whether Shutdown() sends an initial GOAWAY and PING, choosing the
+	// final GOAWAY LastID only once the PING is acknowledged.
+	TwoPhaseShutdown bool
+
+	Timeouts Timeouts
+
+	// Whether a stream whose read or write deadline passes is reset with
+	// RST_STREAM(CANCEL). Otherwise, the stream remains usable once its
+	// deadline is extended.
+	ResetStreamOnDeadline bool
+
+	// Optional hook for interim (1xx) responses, such as 103 (Early
+	// Hints), recieved on locally opened streams ahead of their final
+	// response. Called from the connection's goroutine, and must not block.
+	OnInformational func(id StreamID, fields []HeaderField)
+
+	// Optional hook for streams opened by the peer, which recieves the
+	// owner's handle of each as its initial HEADERS are recieved. Servers
+	// respond through the handle. Without it, peer-opened streams have
+	// no owner. Called from the connection's goroutine, and must not block.
+	OnStream func(stream *StreamHandle)
+
+	// Whether changes of stream state are reported through Events, as
+	// StreamTransitionEvents. Invariant violations then include the
+	// stream's transitions.
+	TraceStreams bool
+	// Whether a violated invariant of a stream's state machine panics.
+	// By default, the stream is reset with INTERNAL_ERROR and the
+	// violation reported through Events.
+	PanicOnStreamInvariant bool
+
+	// Hook for log messages. Defaults to log.Printf.
+	Logf func(format string, args ...interface{})
+	// Hook for connection events. By default, errors, GOAWAYs,
+	// and traced stream transitions are logged through Logf.
+	Events EventHook
+}
+
+// Per-connection modification of a shared Config.
+type ConfigOverride func(*Config)
+
+// Applies overrides to a copy of base (which may be nil), fills defaults
+// of unset fields, and validates the result.
+func resolveConfig(base *Config, overrides ...ConfigOverride) (Config, error) {
+	var config Config
+	if base != nil {
+		config = *base
+	}
+	// Overrides mustn't modify the Settings of base.
+	config = config.clone()
+
+	for _, override := range overrides {
+		override(&config)
+	}
+	err := config.fillAndValidate()
+	return config, err
+}
+
+func (c *Config) fillAndValidate() error {
+	for id, value := range c.Settings {
+		if id < SETTINGS_MIN_SETTING_ID || id > SETTINGS_MAX_SETTING_ID {
+			return fmt.Errorf("invalid setting %v", id)
+		}
+		if id == SETTINGS_ENABLE_PUSH && value > 1 {
+			return fmt.Errorf("invalid SETTINGS_ENABLE_PUSH %v", value)
+		}
+		if id == SETTINGS_INITIAL_WINDOW_SIZE && value > kMaxWindowSize {
+			return fmt.Errorf("SETTINGS_INITIAL_WINDOW_SIZE %v exceeds %v",
+				value, kMaxWindowSize)
+		}
+	}
+	for id := SETTINGS_MIN_SETTING_ID; id <= SETTINGS_MAX_SETTING_ID; id++ {
+		if _, ok := c.Settings[id]; !ok {
+			c.Settings[id] = kSettingDefaults[id]
+		}
+	}
+
+	initialWindow := int(kSettingDefaults[SETTINGS_INITIAL_WINDOW_SIZE])
+	if c.ConnectionWindowSize == 0 {
+		c.ConnectionWindowSize = initialWindow
+	} else if c.ConnectionWindowSize < initialWindow ||
+		c.ConnectionWindowSize > kMaxWindowSize {
+		return fmt.Errorf("ConnectionWindowSize %v not within [%v, %v]",
+			c.ConnectionWindowSize, initialWindow, kMaxWindowSize)
+	}
+
+	if c.MaxRecieveWindow != 0 && (c.MaxRecieveWindow < initialWindow ||
+		c.MaxRecieveWindow > kMaxWindowSize) {
+		return fmt.Errorf("MaxRecieveWindow %v not within [%v, %v]",
+			c.MaxRecieveWindow, initialWindow, kMaxWindowSize)
+	}
+
+	if c.MaxDataPayload == 0 {
+		c.MaxDataPayload = kMaxFramePayload
+	} else if c.MaxDataPayload < 0 || c.MaxDataPayload > kMaxFramePayload {
+		return fmt.Errorf("MaxDataPayload %v not within [1, %v]",
+			c.MaxDataPayload, kMaxFramePayload)
+	}
+
+	if c.Padding == nil {
+		c.Padding = NoPadding{}
+	}
+
+	if c.ClosedStreamRetention == 0 {
+		c.ClosedStreamRetention = kClosedStreamRetention
+	} else if c.ClosedStreamRetention < 0 {
+		return fmt.Errorf("negative ClosedStreamRetention %v",
+			c.ClosedStreamRetention)
+	}
+
+	if c.Timeouts.Handshake < 0 || c.Timeouts.Idle < 0 ||
+		c.Timeouts.MaxAge < 0 {
+		return fmt.Errorf("negative timeout in %+v", c.Timeouts)
+	}
+
+	if c.Logf == nil {
+		c.Logf = log.Printf
+	}
+	if c.Events == nil {
+		c.Events = logEvents{c.Logf}
+	}
+	return nil
+}
+
+// Returns a copy of the Config which doesn't share its Settings.
+func (c Config) clone() Config {
+	settings := make(map[SettingID]uint32, len(c.Settings))
+	for id, value := range c.Settings {
+		settings[id] = value
+	}
+	c.Settings = settings
+	return c
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type ConfigTest struct{}
+
+func (t *ConfigTest) TestDefaults(c *gc.C) {
+	config, err := resolveConfig(nil)
+	c.Assert(err, gc.IsNil)
+
+	for id := SETTINGS_MIN_SETTING_ID; id <= SETTINGS_MAX_SETTING_ID; id++ {
+		c.Check(config.Settings[id], gc.Equals, kSettingDefaults[id])
+	}
+	c.Check(config.ConnectionWindowSize, gc.Equals, 65535)
+	c.Check(config.MaxDataPayload, gc.Equals, 0x3fff)
+	c.Check(config.ClosedStreamRetention, gc.Equals, kClosedStreamRetention)
+	c.Check(config.TwoPhaseShutdown, gc.Equals, false)
+	c.Check(config.Timeouts, gc.Equals, Timeouts{})
+	c.Check(config.Logf, gc.NotNil)
+}
+
+func (t *ConfigTest) TestValidation(c *gc.C) {
+	for _, invalid := range []Config{
+		{Settings: map[SettingID]uint32{0: 1}},
+		{Settings: map[SettingID]uint32{SETTINGS_MAX_SETTING_ID + 1: 1}},
+		{Settings: map[SettingID]uint32{SETTINGS_ENABLE_PUSH: 2}},
+		{Settings: map[SettingID]uint32{
+			SETTINGS_INITIAL_WINDOW_SIZE: kMaxWindowSize + 1}},
+		{ConnectionWindowSize: 1024},
+		{ConnectionWindowSize: kMaxWindowSize + 1},
+		{MaxRecieveWindow: 1024},
+		{MaxRecieveWindow: kMaxWindowSize + 1},
+		{MaxDataPayload: -1},
+		{MaxDataPayload: 0x4000},
+		{ClosedStreamRetention: -1},
+		{Timeouts: Timeouts{Idle: -time.Second}},
+	} {
+		_, err := resolveConfig(&invalid)
+		c.Check(err, gc.NotNil, gc.Commentf("%+v", invalid))
+	}
+}
+
+func (t *ConfigTest) TestOverridesDontModifyBase(c *gc.C) {
+	base := &Config{
+		Settings: map[SettingID]uint32{SETTINGS_MAX_CONCURRENT_STREAMS: 10},
+	}
+	config, err := resolveConfig(base, func(config *Config) {
+		config.Settings[SETTINGS_MAX_CONCURRENT_STREAMS] = 20
+		config.TwoPhaseShutdown = true
+	})
+	c.Assert(err, gc.IsNil)
+
+	c.Check(config.Settings[SETTINGS_MAX_CONCURRENT_STREAMS], gc.Equals,
+		uint32(20))
+	c.Check(config.TwoPhaseShutdown, gc.Equals, true)
+
+	c.Check(base.Settings, gc.DeepEquals,
+		map[SettingID]uint32{SETTINGS_MAX_CONCURRENT_STREAMS: 10})
+	c.Check(base.TwoPhaseShutdown, gc.Equals, false)
+}
+
+func (t *ConfigTest) TestNewConnection(c *gc.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recvMux, sendMux := make(chan Frame), make(chan Frame)
+	logs := make(chan string, 10)
+
+	base := &Config{
+		Settings: map[SettingID]uint32{
+			SETTINGS_MAX_CONCURRENT_STREAMS: 100,
+			SETTINGS_INITIAL_WINDOW_SIZE:    65535,
+		},
+		ConnectionWindowSize: 1 << 20,
+	}
+	handle, err := NewConnection(ctx, base, true,
+		&fakeTransport{closed: make(chan struct{})}, recvMux, sendMux,
+		func(config *Config) {
+			config.Logf = func(format string, args ...interface{}) {
+				logs <- fmt.Sprintf(format, args...)
+			}
+		})
+	c.Assert(err, gc.IsNil)
+
+	// Only non-default settings are sent, followed by
+	// the increase of the connection window.
+	settings := (<-sendMux).(*SettingsFrame)
+	c.Check(settings.Settings, gc.DeepEquals,
+		map[SettingID]uint32{SETTINGS_MAX_CONCURRENT_STREAMS: 100})
+	update := (<-sendMux).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(0))
+	c.Check(update.SizeDelta, gc.Equals, uint32(1<<20-65535))
+
+	// The effective config may be inspected, but not modified.
+	config := handle.Config()
+	c.Check(config.Settings[SETTINGS_ENABLE_PUSH], gc.Equals, uint32(1))
+	c.Check(config.MaxDataPayload, gc.Equals, 0x3fff)
+	config.Settings[SETTINGS_ENABLE_PUSH] = 0
+	c.Check(handle.Config().Settings[SETTINGS_ENABLE_PUSH], gc.Equals,
+		uint32(1))
+
+	// Errors are logged through the hook.
+	recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 3}, SizeDelta: 1}
+	c.Check(<-logs, gc.Matches, "connection PROTOCOL_ERROR: .*idle stream 3")
+	c.Check(<-sendMux, gc.FitsTypeOf, &GoAwayFrame{})
+
+	<-handle.Done()
+	checkNoLeakedGoroutines(c)
+}
+
+func (t *ConfigTest) TestNewConnectionRejectsInvalidConfig(c *gc.C) {
+	_, err := NewConnection(context.Background(),
+		&Config{MaxDataPayload: -1}, true, nil, nil, nil)
+	c.Check(err, gc.ErrorMatches, "MaxDataPayload -1 not within .*")
+}
+
+var _ = gc.Suite(&ConfigTest{})
@@ -4,117 +4,945 @@
 package http2
 
 import (
+	"context"
 	"errors"
-	"log"
+	"fmt"
+	"io"
+	"sync"
 )
 
 var (
-	kConnectionStallError error = errors.New("Connection stall")
-	kStreamStallError     error = errors.New("Stream stall")
+	kConnectionStallError     error = errors.New("Connection stall")
+	kStreamStallError         error = errors.New("Stream stall")
+	kConnectionClosedError    error = errors.New("Connection closed")
+	kStreamIDsExhaustedError  error = errors.New("Stream IDs exhausted")
+	kConnectionShutdownError  error = errors.New("Connection shutting down")
+	kConnectionGoAwayRecieved error = errors.New("GOAWAY recieved")
 )
 
+// Largest permitted StreamID. Sent as the LastID of an initial GOAWAY,
+// to signal imminent shutdown without yet refusing any streams.
+const kMaxStreamID StreamID = 0x7fffffff
+
+// Opaque data of the PING which follows an initial GOAWAY.
+const kShutdownPingData uint64 = 0x474f41574159
+
+// Application handle to a connection. Methods communicate with the
+// mainLoop() goroutine, which owns all connection state.
+type Connection struct {
+	queueMux      chan<- Frame
+	consumeMux    chan<- consumedData
+	windowMux     chan<- windowRequest
+	openMux       chan<- openRequest
+	cancelOpenMux chan<- chan<- openReply
+	shutdownMux   chan<- struct{}
+
+	closeMux  chan struct{} // Closed to force an immediate close.
+	closeOnce sync.Once
+
+	done <-chan struct{} // Closed when mainLoop() exits.
+	// Reason the connection closed. Written by mainLoop() before done
+	// is closed, and thereafter read-only.
+	err *Error
+
+	config Config // Effective configuration. Read-only.
+
+	mu         sync.Mutex
+	peerGoAway *GoAwayFrame // Guarded by mu. Written by mainLoop().
+}
+
+// Returns the effective configuration of the connection: its Config,
+// with overrides applied and defaults filled.
+func (c *Connection) Config() Config {
+	return c.config.clone()
+}
+
+// Returns a channel which is closed once the connection has closed,
+// and all of its streams have been failed.
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
+}
+
+// Returns Err() as an error, which is nil (rather than a nil *Error)
+// if the connection closed cleanly.
+func (c *Connection) closeErr() error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns nil while the connection is open, or if it closed following
+// a graceful Shutdown(). Otherwise, returns the reason it closed: the
+// ConnectionError which was sent in a GOAWAY, or CANCEL if the
+// connection's context ended or it was forcibly closed.
+func (c *Connection) Err() *Error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Gracefully shuts down the connection. A GOAWAY is sent, after which
+// new streams of the peer are ignored. Streams which are already open
+// are allowed to complete, after which the transport is closed. If ctx
+// expires first, the transport is closed immediately and ctx.Err()
+// is returned. If the connection instead closed with an error, as
+// reported by Err(), that error is returned.
+func (c *Connection) Shutdown(ctx context.Context) error {
+	select {
+	case c.shutdownMux <- struct{}{}:
+	case <-c.done:
+		return c.closeErr()
+	case <-ctx.Done():
+		c.forceClose()
+		return ctx.Err()
+	}
+	select {
+	case <-c.done:
+		return c.closeErr()
+	case <-ctx.Done():
+		c.forceClose()
+		return ctx.Err()
+	}
+}
+
+// Opens a new stream, assigning it the next local StreamID and queuing
+// the HEADERS frame which initiates it. If the peer's
+// SETTINGS_MAX_CONCURRENT_STREAMS has been reached, OpenStream blocks
+// until another stream closes or ctx expires.
+//
+// Returned errors are Retryable() if the stream couldn't be opened
+// because the connection is closed or shutting down, or because its
+// StreamIDs are exhausted. In each case, the request should be
+// attempted on a fresh connection.
+func (c *Connection) OpenStream(ctx context.Context,
+	headers *HeadersFrame) (*StreamHandle, *Error) {
+
+	closed := &Error{Code: REFUSED_STREAM, Level: RecoverableError,
+		Err: kConnectionClosedError}
+
+	if err := ctx.Err(); err != nil {
+		return nil, &Error{Code: CANCEL, Level: RecoverableError, Err: err}
+	}
+	reply := make(chan openReply, 1)
+	select {
+	case c.openMux <- openRequest{ctx, headers, reply}:
+	case <-c.done:
+		return nil, closed
+	}
+
+	select {
+	case result := <-reply:
+		return result.handle, result.err
+	case <-c.done:
+		return nil, closed
+	case <-ctx.Done():
+	}
+	// Withdraw the request. mainLoop() replies with either a
+	// cancellation, or the stream it opened in the meantime.
+	select {
+	case c.cancelOpenMux <- reply:
+	case <-c.done:
+		return nil, closed
+	}
+	result := <-reply
+	return result.handle, result.err
+}
+
+// Reports that n bytes of DATA recieved on the stream have been taken
+// from its buffer, by a read or as the buffer was discarded. Consumed
+// bytes are returned to the peer, through WINDOW_UPDATE, once they're a
+// sufficient fraction of the stream or connection receive window. Bytes
+// of a reset stream are ignored, as its unconsumed bytes were released
+// as it was reset, and bytes beyond those recieved but not yet consumed
+// are disregarded. Only the stream's handle consumes bytes, so that the
+// peer's window never exceeds the memory its buffer may hold.
+func (c *Connection) consume(id StreamID, n int) error {
+	if n < 0 {
+		return &Error{Code: INTERNAL_ERROR, Level: RecoverableError,
+			Err: fmt.Errorf("negative consumed bytes %v of stream %v", n, id)}
+	}
+	select {
+	case c.consumeMux <- consumedData{id, n}:
+	case <-c.done:
+	}
+	return nil
+}
+
+type consumedData struct {
+	id StreamID
+	n  int
+}
+
+type openRequest struct {
+	ctx     context.Context
+	headers *HeadersFrame
+	reply   chan<- openReply
+}
+type openReply struct {
+	handle *StreamHandle
+	err    *Error
+}
+
+// Returns the most recent GOAWAY recieved from the peer, or nil if
+// none has been. Its Error carries the peer's error code, and
+// any debug data as the error text.
+func (c *Connection) PeerGoAway() *GoAwayFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerGoAway
+}
+
+func (c *Connection) forceClose() {
+	c.closeOnce.Do(func() { close(c.closeMux) })
+	<-c.done
+}
+
 // Manages the state of a Connection. Owned and only accessible
 // from within the Connection.mainLoop() goroutine.
 type connection struct {
+	handle *Connection
+	// The connection is closed when ctx ends.
+	ctx    context.Context
+	config Config
+
+	// Servers initiate even-numbered streams, and clients odd.
+	isServer bool
+
 	recvFlow          RecieveFlow
 	sendFlowAvailable int
 
-	streams map[StreamID]*Stream
+	// Streams which are idle or open. Closed streams are retired to
+	// closedStreams, and re-created from it if further frames arrive.
+	streams       map[StreamID]*Stream
+	closedStreams closedStreams
+	counts        streamCounts
+	// Bytes recieved on retired streams which remain buffered for their
+	// owners, and are yet to be consumed.
+	retiredUnconsumed map[StreamID]int
 
 	// Muxed together.
-	recvMux  <-chan Frame // Frames read by the read loop.
-	sendMux  chan<- Frame // Frames written to the write loop.
-	queueMux <-chan Frame // Frames to write, queued by clients.
+	recvMux    <-chan Frame // Frames read by the read loop.
+	sendMux    chan<- Frame // Frames written to the write loop.
+	queueMux   <-chan Frame // Frames to write, queued by clients.
+	consumeMux <-chan consumedData
+	windowMux  <-chan windowRequest
+	openMux    <-chan openRequest
+
+	// Requests to open a stream, blocked on the peer's
+	// SETTINGS_MAX_CONCURRENT_STREAMS.
+	pendingOpens  []openRequest
+	cancelOpenMux <-chan chan<- openReply
+
+	// Control of the connection lifecycle.
+	shutdownMux <-chan struct{}
+	closeMux    <-chan struct{}
+	done        chan<- struct{}
+
+	transport io.Closer
 
 	writeQueue writeQueue
+	// Frame which has been dequeued and prepared, but is
+	// not yet accepted by the write loop.
+	pendingSend Frame
+
+	// Highest StreamID opened by the peer which we've processed.
+	lastRemoteID StreamID
+	// StreamID to be assigned to the next locally opened stream.
+	nextLocalID StreamID
+
+	// Settings we've sent, and those recieved from the peer.
+	localSettings [SETTINGS_MAX_SETTING_ID + 1]uint32
+	peerSettings  [SETTINGS_MAX_SETTING_ID + 1]uint32
+
+	// SETTINGS we've sent which the peer hasn't yet acknowledged, in
+	// sent order, and the last SETTINGS_INITIAL_WINDOW_SIZE it has.
+	unackedSettings    []*SettingsFrame
+	ackedInitialWindow uint32
+	// Recieve window of streams: the largest SETTINGS_INITIAL_WINDOW_SIZE
+	// the peer may be applying. Increases apply as they're sent, and
+	// decreases only once acknowledged.
+	recvInitialWindow int
+
+	// Shutdown state. With Config.TwoPhaseShutdown, an initial GOAWAY
+	// with kMaxStreamID is followed by a PING, and the final GOAWAY is
+	// sent only on receipt of the PING's ACK. This gives peer streams
+	// already in flight a chance to arrive before the final LastID is
+	// chosen.
+	shutdownPing *PingFrame
+	goAwaySent   bool
+	goAwayLastID StreamID
+
+	// Set on GOAWAY from the peer. Local streams above the peer's
+	// LastID (including any new streams) won't be processed.
+	goAwayRecieved   bool
+	peerGoAwayLastID StreamID
+
+	// GOAWAY sent on a ConnectionError. The connection closes once it's
+	// been written.
+	fatalGoAway *GoAwayFrame
+
+	clock            clock
+	deadlines        deadlines
+	bdp              bdpEstimator
+	settingsRecieved bool // Whether the peer's initial SETTINGS arrived.
+}
+
+// Creates and starts a connection, which exchanges frames with the
+// caller's read and write loops over recvMux and sendMux. Ownership of
+// sendMux passes to the connection: the caller must neither send on nor
+// close it, and the connection closes it as the connection closes,
+// ending the caller's write loop. The read loop closes recvMux as the
+// transport ends, closing the connection with an error. The connection
+// also closes when ctx ends.
+// Its configuration is config (which may be nil for defaults) with
+// overrides applied, and an error is returned if the result is invalid.
+func NewConnection(ctx context.Context, config *Config, isServer bool,
+	transport io.Closer, recvMux <-chan Frame, sendMux chan<- Frame,
+	overrides ...ConfigOverride) (*Connection, error) {
+
+	effective, err := resolveConfig(config, overrides...)
+	if err != nil {
+		return nil, err
+	}
+	handle, conn := newConnection(ctx, effective, isServer,
+		transport, recvMux, sendMux)
+	go conn.mainLoop()
+	return handle, nil
+}
+
+// Builds a connection having a resolved config. Its initial SETTINGS,
+// and connection WINDOW_UPDATE if required, are queued.
+func newConnection(ctx context.Context, config Config, isServer bool,
+	transport io.Closer, recvMux <-chan Frame,
+	sendMux chan<- Frame) (*Connection, *connection) {
+
+	queueMux := make(chan Frame)
+	consumeMux := make(chan consumedData)
+	windowMux := make(chan windowRequest)
+	openMux := make(chan openRequest)
+	cancelOpenMux := make(chan chan<- openReply)
+	shutdownMux := make(chan struct{})
+	closeMux := make(chan struct{})
+	done := make(chan struct{})
+
+	handle := &Connection{
+		queueMux:      queueMux,
+		consumeMux:    consumeMux,
+		windowMux:     windowMux,
+		openMux:       openMux,
+		cancelOpenMux: cancelOpenMux,
+		shutdownMux:   shutdownMux,
+		closeMux:      closeMux,
+		done:          done,
+		config:        config,
+	}
+	conn := &connection{
+		handle:   handle,
+		ctx:      ctx,
+		config:   config,
+		isServer: isServer,
+		streams:  make(map[StreamID]*Stream),
+		closedStreams: closedStreams{
+			capacity: config.ClosedStreamRetention,
+		},
+		retiredUnconsumed: make(map[StreamID]int),
+		recvMux:           recvMux,
+		sendMux:           sendMux,
+		queueMux:          queueMux,
+		consumeMux:        consumeMux,
+		windowMux:         windowMux,
+		openMux:           openMux,
+		cancelOpenMux:     cancelOpenMux,
+		shutdownMux:       shutdownMux,
+		closeMux:          closeMux,
+		done:              done,
+		transport:         transport,
+		writeQueue: writeQueue{
+			priorities: streamPriorities{capacity: kPriorityRetention},
+		},
+		clock:              systemClock{},
+		localSettings:      kSettingDefaults,
+		peerSettings:       kSettingDefaults,
+		ackedInitialWindow: kSettingDefaults[SETTINGS_INITIAL_WINDOW_SIZE],
+		recvInitialWindow: int(
+			kSettingDefaults[SETTINGS_INITIAL_WINDOW_SIZE]),
+		// Connection windows always begin at the default initial
+		// window size, and are changed only by WINDOW_UPDATE.
+		sendFlowAvailable: int(kSettingDefaults[SETTINGS_INITIAL_WINDOW_SIZE]),
+		recvFlow: RecieveFlow{
+			WinSize: config.ConnectionWindowSize,
+		},
+	}
+	if isServer {
+		conn.nextLocalID = 2
+	} else {
+		conn.nextLocalID = 1
+	}
+
+	// Only settings which differ from their defaults are sent.
+	initial := &SettingsFrame{Settings: make(map[SettingID]uint32)}
+	for id, value := range config.Settings {
+		if value != kSettingDefaults[id] {
+			initial.Settings[id] = value
+		}
+	}
+	conn.writeQueue.enqueueBack(initial)
+
+	if delta := config.ConnectionWindowSize -
+		int(kSettingDefaults[SETTINGS_INITIAL_WINDOW_SIZE]); delta != 0 {
+		conn.writeQueue.enqueueBack(&WindowUpdateFrame{SizeDelta: uint32(delta)})
+	}
+	return handle, conn
 }
 
 func (c *connection) mainLoop() {
-	var pendingSend Frame
+	var err *Error
+	defer func() { c.close(err) }()
+
+	c.deadlines.started = c.clock.Now()
 
 	maybeSendMux := func() chan<- Frame {
-		if pendingSend != nil {
+		if c.pendingSend != nil {
 			return c.sendMux
 		}
 		return nil
 	}
 
 	for {
-		// Deque the next frame to write.
-		if pendingSend == nil {
-			if next, ok := c.writeQueue.deque(); ok {
-				if err := c.prepareToSendFrame(next); err == nil {
-					pendingSend = next
-				} else {
-					c.handleError(err, next)
-				}
+		c.retireClosedStreams()
+		c.servicePendingOpens()
+		if c.pendingSend == nil && c.shutdownComplete() {
+			return
+		}
+		c.armTimeouts()
+
+		// Deque the next frame to write. Frames which fail to
+		// prepare are handled, and the next frame is tried.
+		for c.pendingSend == nil {
+			next, ok := c.writeQueue.deque()
+			if !ok {
+				break
+			}
+			if err := c.prepareToSendFrame(next); err == nil {
+				c.pendingSend = next
+			} else if err.Err == kConnectionStallError ||
+				err.Err == kStreamStallError {
+				continue // Frame was parked, pending WINDOW_UPDATE.
+			} else {
+				c.handleError(err, next)
 			}
 		}
 
 		// Connection loop makes progress when:
 		//  * A frame to write is queued, OR
 		//  * A frame is written, OR
-		//  * A frame is recieved.
+		//  * A frame is recieved, OR
+		//  * Recieved data is consumed, OR
+		//  * A stream's recieve window is resized, OR
+		//  * A stream is opened, OR
+		//  * A timeout expires, OR
+		//  * Shutdown or close is requested.
 		select {
-		case maybeSendMux() <- pendingSend:
-			pendingSend = nil
+		case maybeSendMux() <- c.pendingSend:
+			if goAway, ok := c.pendingSend.(*GoAwayFrame); ok {
+				c.config.Events.OnEvent(GoAwaySentEvent{goAway})
+			}
+			if c.pendingSend == c.fatalGoAway {
+				err = &c.fatalGoAway.Error
+				return
+			}
+			c.pendingSend = nil
 		case frame := <-c.queueMux:
 			c.writeQueue.enqueueBack(frame)
-		case frame := <-c.recvMux:
+		case frame, ok := <-c.recvMux:
+			if !ok {
+				// The read loop ended, as with transport EOF.
+				err = &Error{Code: CANCEL, Level: ConnectionError,
+					Err: fmt.Errorf("transport closed: %w", io.EOF)}
+				return
+			}
 			if err := c.recieveFrame(frame); err != nil {
 				c.handleError(err, frame)
 			}
-			// TODO(johng): consumeMux
+		case consumed := <-c.consumeMux:
+			c.consume(consumed.id, consumed.n)
+		case request := <-c.windowMux:
+			request.reply <- c.resizeRecieveWindow(request.id, request.size)
+		case request := <-c.openMux:
+			c.pendingOpens = append(c.pendingOpens, request)
+		case reply := <-c.cancelOpenMux:
+			c.cancelPendingOpen(reply)
+		case <-c.deadlines.timer:
+			c.onTimeout()
+		case <-c.shutdownMux:
+			c.beginShutdown()
+		case <-c.closeMux:
+			err = &Error{Code: CANCEL, Level: ConnectionError,
+				Err: kConnectionClosedError}
+			return
+		case <-c.ctx.Done():
+			err = &Error{Code: CANCEL, Level: ConnectionError,
+				Err: c.ctx.Err()}
+			return
+		}
+	}
+}
+
+// Closes the connection following exit of mainLoop(), for reason err
+// (nil on graceful shutdown). Owners of remaining streams, and pending
+// OpenStream() calls, are failed. The write loop is signaled by closing
+// sendMux, and the transport is closed.
+func (c *connection) close(err *Error) {
+	c.handle.err = err
+	c.disarmTimeouts()
+
+	// Following a graceful shutdown, remaining streams are idle.
+	streamErr := &Error{Code: CANCEL, Level: RecoverableError,
+		Err: kConnectionClosedError}
+	if err != nil {
+		streamErr = &Error{Code: err.Code, Level: ConnectionError,
+			Err: fmt.Errorf("connection closed: %w", err)}
+	}
+	for _, stream := range c.streams {
+		if stream.State != Closed && stream.State != ClosedWithSentReset {
+			stream.abandon(streamErr)
+		}
+	}
+	for _, request := range c.pendingOpens {
+		request.reply <- openReply{err: streamErr}
+	}
+	c.pendingOpens = nil
+
+	// sendMux is owned by the connection (see NewConnection).
+	close(c.sendMux)
+	c.transport.Close()
+	close(c.done)
+}
+
+// Sends GOAWAY, either directly with the final LastID or (with
+// Config.TwoPhaseShutdown) as an initial GOAWAY and PING.
+func (c *connection) beginShutdown() {
+	if c.goAwaySent || c.shutdownPing != nil {
+		return // Already shutting down.
+	}
+	if !c.config.TwoPhaseShutdown {
+		c.sendGoAway(Error{Code: NO_ERROR})
+		return
+	}
+	c.writeQueue.enqueueBack(&GoAwayFrame{LastID: kMaxStreamID})
+	c.shutdownPing = &PingFrame{OpaqueData: kShutdownPingData}
+	c.writeQueue.enqueueBack(c.shutdownPing)
+}
+
+// Queues a GOAWAY reporting the last processed peer stream. Further
+// streams opened by the peer are ignored.
+func (c *connection) sendGoAway(err Error) {
+	c.goAwaySent = true
+	c.goAwayLastID = c.lastRemoteID
+	c.writeQueue.enqueueBack(&GoAwayFrame{
+		LastID: c.goAwayLastID,
+		Error:  err,
+	})
+}
+
+// Shutdown is complete once a final GOAWAY is sent or recieved,
+// and all processed streams have closed.
+func (c *connection) shutdownComplete() bool {
+	if !(c.goAwaySent || c.goAwayRecieved) || !c.writeQueue.empty() {
+		return false
+	}
+	return c.counts.active == 0
+}
+
+// Opens streams for pending requests, in order, while the peer's
+// SETTINGS_MAX_CONCURRENT_STREAMS allows.
+func (c *connection) servicePendingOpens() {
+	for len(c.pendingOpens) != 0 {
+		request := c.pendingOpens[0]
+
+		var reply openReply
+		if err := request.ctx.Err(); err != nil {
+			reply.err = &Error{Code: CANCEL, Level: RecoverableError, Err: err}
+		} else if err := c.checkCanOpen(); err != nil {
+			reply.err = err
+		} else if uint32(c.concurrentStreamCount(true)) >=
+			c.peerSettings[SETTINGS_MAX_CONCURRENT_STREAMS] {
+			return // Wait for a stream to close.
+		} else {
+			reply.handle = c.openStream(request.headers)
 		}
+		request.reply <- reply
+		c.pendingOpens = c.pendingOpens[1:]
 	}
 }
 
+func (c *connection) cancelPendingOpen(reply chan<- openReply) {
+	for i, request := range c.pendingOpens {
+		if request.reply == reply {
+			request.reply <- openReply{err: &Error{Code: CANCEL,
+				Level: RecoverableError, Err: request.ctx.Err()}}
+			c.pendingOpens = append(c.pendingOpens[:i], c.pendingOpens[i+1:]...)
+			return
+		}
+	}
+	// Already serviced. The reply is buffered.
+}
+
+// Returns a Retryable() error if new streams may not be opened.
+func (c *connection) checkCanOpen() *Error {
+	refused := func(err error) *Error {
+		return &Error{Code: REFUSED_STREAM, Level: RecoverableError, Err: err}
+	}
+	if c.goAwayRecieved {
+		return refused(kConnectionGoAwayRecieved)
+	}
+	if c.goAwaySent || c.shutdownPing != nil {
+		return refused(kConnectionShutdownError)
+	}
+	if c.nextLocalID > kMaxStreamID {
+		// A fresh connection is required. Shut this one down.
+		c.beginShutdown()
+		return refused(kStreamIDsExhaustedError)
+	}
+	return nil
+}
+
+// Allocates the next local StreamID to a new stream, and queues
+// its initiating HEADERS.
+func (c *connection) openStream(headers *HeadersFrame) *StreamHandle {
+	stream, handle := newStream(c.nextLocalID,
+		int(c.peerSettings[SETTINGS_INITIAL_WINDOW_SIZE]),
+		c.recvInitialWindow)
+	handle.conn = c.handle
+	handle.send.sendHeaders()
+	if headers.Flags&END_STREAM != 0 {
+		handle.send.close() // The stream has no DATA.
+	}
+	c.addStream(stream)
+	c.nextLocalID += 2
+
+	headers.StreamID = stream.ID
+	c.writeQueue.enqueueBack(headers)
+	return handle
+}
+
+// Counts streams initiated locally (or by the peer) which count toward
+// SETTINGS_MAX_CONCURRENT_STREAMS. Local streams which have been
+// allocated, but whose HEADERS are yet to be sent, are included.
+func (c *connection) concurrentStreamCount(local bool) int {
+	count := 0
+	for id, stream := range c.streams {
+		if c.isLocalID(id) != local {
+			continue
+		}
+		if stream.State.countsTowardConcurrency() ||
+			(local && stream.State == Idle) {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Validates a StreamID being opened by the peer. Idle peer streams
+// having a lower StreamID are implicitly closed.
+func (c *connection) validateRemoteOpen(id StreamID) *Error {
+	if id == 0 {
+		return protocolError("peer opened stream 0")
+	} else if c.isLocalID(id) {
+		return protocolError("peer opened stream %v of local parity", id)
+	} else if id <= c.lastRemoteID {
+		return protocolError("peer opened stream %v, but last opened was %v",
+			id, c.lastRemoteID)
+	}
+	for otherID, stream := range c.streams {
+		if !c.isLocalID(otherID) && otherID < id && stream.State == Idle {
+			stream.setStateImplicitly(Closed)
+		}
+	}
+	return nil
+}
+
 func (c *connection) prepareToSendHeadersFrame(headers *HeadersFrame) *Error {
 	stream := c.getOrCreateStream(headers.StreamID)
-	return stream.onHeaders(Send, headers.Flags&END_STREAM != 0)
+	if stream.State == Idle &&
+		!(c.isLocalID(stream.ID) && c.wasOpened(stream.ID)) {
+		// Only allocated local streams may be opened by sending HEADERS.
+		return internalError("HEADERS of unopened stream %v", stream.ID)
+	}
+	fin := headers.Flags&END_STREAM != 0
+	if isInformational(headers.Fields) {
+		err := validateInformational(stream.ID, headers.Fields, fin)
+		if err == nil && stream.headersSent {
+			err = protocolError("interim response of stream %v "+
+				"follows its final response", stream.ID)
+		}
+		if err != nil {
+			// The owner's frame is dropped.
+			err.Code = INTERNAL_ERROR
+			err.Level = RecoverableError
+			return err
+		}
+	} else {
+		stream.headersSent = true
+	}
+	if err := stream.onHeaders(Send, fin); err != nil {
+		return err
+	}
+	if fin {
+		stream.send.close()
+	}
+	// Padding is chosen as the header block is encoded.
+	headers.padding = c.config.Padding
+	return nil
 }
 
 func (c *connection) recieveHeadersFrame(headers *HeadersFrame) *Error {
 	stream := c.getOrCreateStream(headers.StreamID)
-	return stream.onHeaders(Receive, headers.Flags&END_STREAM != 0)
+	opening := stream.State == Idle
+
+	if opening {
+		if err := c.validateRemoteOpen(headers.StreamID); err != nil {
+			return err
+		}
+	}
+	// The stream is ended only after the owner is informed of the HEADERS.
+	fin := headers.Flags&END_STREAM != 0
+	if err := stream.onHeaders(Receive, false); err != nil {
+		return err
+	}
+	if !stream.headersRecieved && c.isLocalID(stream.ID) &&
+		isInformational(headers.Fields) {
+		// An interim response, to be followed by the final response.
+		stream.informationalRecieved += 1
+		err := validateInformational(stream.ID, headers.Fields, fin)
+		if err == nil &&
+			stream.informationalRecieved > kMaxInformationalResponses {
+			err = protocolError("stream %v exceeded %v interim responses",
+				stream.ID, kMaxInformationalResponses)
+		}
+		if err != nil {
+			err.Level = StreamError
+			return err
+		}
+		if c.config.OnInformational != nil {
+			c.config.OnInformational(stream.ID, headers.Fields)
+		}
+		stream.events.push(&HeadersEvent{
+			Fields: headers.Fields, Informational: true})
+		return nil
+	}
+	trailers := stream.headersRecieved
+	if trailers {
+		// Trailers, which must end the stream.
+		err := validateTrailers(headers.Fields)
+		if err == nil && !fin {
+			err = protocolError("trailers of stream %v without END_STREAM",
+				stream.ID)
+		}
+		if err != nil {
+			err.Level = StreamError
+			return err
+		}
+		stream.recv.finish(headers.Fields)
+	} else if fin {
+		stream.recv.write(nil, false, true)
+	}
+	stream.headersRecieved = true
+	stream.events.push(&HeadersEvent{Fields: headers.Fields, Trailers: trailers})
+	if fin {
+		if err := stream.onRemoteFin(HEADERS); err != nil {
+			return err
+		}
+	}
+	if !c.isLocalID(headers.StreamID) && headers.StreamID > c.lastRemoteID {
+		c.lastRemoteID = headers.StreamID
+	}
+	if headers.Flags&(PRIORITY_GROUP|PRIORITY_DEPENDENCY) != 0 {
+		c.writeQueue.prioritize(headers.StreamID, headers.FramePriority)
+	}
+	if opening && uint32(c.concurrentStreamCount(false)) >
+		c.localSettings[SETTINGS_MAX_CONCURRENT_STREAMS] {
+		// Opening this stream exceeded our advertised limit.
+		return &Error{Code: REFUSED_STREAM, Level: StreamError,
+			Err: fmt.Errorf("stream %v exceeds %v concurrent streams",
+				headers.StreamID,
+				c.localSettings[SETTINGS_MAX_CONCURRENT_STREAMS])}
+	}
+	if opening && stream.owner != nil {
+		if c.config.OnStream != nil {
+			c.config.OnStream(stream.owner)
+		}
+		stream.owner = nil
+	}
+	return nil
 }
 
-func (c *connection) prepareToSendDataFrame(data *DataFrame) *Error {
-	stream := c.getOrCreateStream(data.StreamID)
-	if err := stream.onData(Send, data.Flags&END_STREAM != 0); err != nil {
+// PRIORITY may be recieved for a stream in any state, including idle and
+// closed streams, and doesn't change it. Priorities are recorded without
+// creating Streams, so prioritizing an idle stream doesn't open it.
+func (c *connection) recievePriorityFrame(priority *PriorityFrame) *Error {
+	if priority.StreamID == 0 {
+		return protocolError("recieved PRIORITY on stream 0")
+	}
+	if priority.Flags&PRIORITY_DEPENDENCY != 0 &&
+		priority.StreamDependency == priority.StreamID {
+		err := protocolError("stream %v depends on itself", priority.StreamID)
+		if stream, ok := c.streams[priority.StreamID]; ok &&
+			stream.State != Idle &&
+			stream.State != Closed &&
+			stream.State != ClosedWithSentReset {
+			err.Level = StreamError
+		} else {
+			// Idle and closed streams can't be reset. Ignore the frame.
+			err.Level = RecoverableError
+		}
 		return err
 	}
+	c.writeQueue.prioritize(priority.StreamID, priority.FramePriority)
+	return nil
+}
 
-	// Determine how much of the frame we're allowed to send.
-	bound := int(^kFrameLengthReservedMask) // Frame payload maximum size.
+func (c *connection) prepareToSendSettingsFrame(settings *SettingsFrame) *Error {
+	if settings.Flags&ACK != 0 {
+		return nil
+	}
+	// Settings take effect as they're sent, rather than on acknowledgement,
+	// except for reductions of the recieve window of streams.
+	for id, value := range settings.Settings {
+		c.localSettings[id] = value
+	}
+	c.unackedSettings = append(c.unackedSettings, settings)
+	c.updateRecvInitialWindow()
+	return nil
+}
 
-	if c.sendFlowAvailable == 0 {
-		// We're stalled on connection flow control.
-		c.writeQueue.enqueueFront(data)
-		//c.writeQueue.stallAllStreams()
-		//c.writeQueue.enqueueFront(&BlockedFrame{})
-		return &Error{Code: FLOW_CONTROL_ERROR, Level: RecoverableError,
-			Err: kConnectionStallError}
-	} else if c.sendFlowAvailable < bound {
-		bound = c.sendFlowAvailable
+// Resizes the recieve windows of all streams to the largest
+// SETTINGS_INITIAL_WINDOW_SIZE which the peer may be applying: that
+// last acknowledged, or any not yet acknowledged.
+func (c *connection) updateRecvInitialWindow() {
+	window := c.ackedInitialWindow
+	for _, settings := range c.unackedSettings {
+		if value, ok := settings.Settings[SETTINGS_INITIAL_WINDOW_SIZE]; ok &&
+			value > window {
+			window = value
+		}
+	}
+	delta := int(window) - c.recvInitialWindow
+	for _, stream := range c.streams {
+		stream.RecvFlow.WinSize += delta
+	}
+	c.recvInitialWindow = int(window)
+}
+
+func (c *connection) recieveSettingsFrame(settings *SettingsFrame) *Error {
+	if settings.Flags&ACK != 0 {
+		// Acknowledges the SETTINGS we sent least recently.
+		if len(c.unackedSettings) == 0 {
+			return nil
+		}
+		acked := c.unackedSettings[0]
+		c.unackedSettings = c.unackedSettings[1:]
+		if value, ok := acked.Settings[SETTINGS_INITIAL_WINDOW_SIZE]; ok {
+			c.ackedInitialWindow = value
+		}
+		c.updateRecvInitialWindow()
+		return nil
+	}
+	c.settingsRecieved = true
+
+	// Settings are validated before any are applied. Settings of unknown
+	// ID are ignored.
+	for id, value := range settings.Settings {
+		if id == SETTINGS_ENABLE_PUSH && value > 1 {
+			return protocolError("invalid SETTINGS_ENABLE_PUSH %v", value)
+		} else if id == SETTINGS_INITIAL_WINDOW_SIZE && value > kMaxWindowSize {
+			return flowControlError("SETTINGS_INITIAL_WINDOW_SIZE of %v", value)
+		}
+	}
+	for id, value := range settings.Settings {
+		if id < SETTINGS_MIN_SETTING_ID || id > SETTINGS_MAX_SETTING_ID {
+			continue
+		} else if id == SETTINGS_INITIAL_WINDOW_SIZE {
+			if err := c.applyInitialWindowSize(value); err != nil {
+				return err
+			}
+		}
+		c.peerSettings[id] = value
 	}
+	c.writeQueue.enqueueFront(&SettingsFrame{
+		FramePrefix: FramePrefix{Flags: ACK},
+	})
+	return nil
+}
 
-	if stream.SendFlowAvailable == 0 {
-		// We're stalled on stream flow control.
-		c.writeQueue.enqueueFront(data)
-		//c.writeQueue.stallStream(stream.ID)
-		//c.writeQueue.enqueueFront(
-		//  &BlockedFrame{FramePrefix{StreamID: data.StreamID}})
-		return &Error{Code: FLOW_CONTROL_ERROR, Level: RecoverableError,
-			Err: kStreamStallError}
-	} else if stream.SendFlowAvailable < bound {
-		bound = stream.SendFlowAvailable
+func (c *connection) prepareToSendDataFrame(data *DataFrame) *Error {
+	stream := c.getOrCreateStream(data.StreamID)
+	// Check that DATA may be sent. END_STREAM is applied only once
+	// the frame is known not to be stalled or split.
+	if err := stream.onData(Send, false); err != nil {
+		return err
 	}
 
-	// Split the frame if needed, and update flow control state.
-	if bound < data.PayloadLength() {
-		remainder := data.SplitAt(bound)
-		c.writeQueue.enqueueFront(remainder)
+	// Whether the frame is padded by Config.Padding, rather than its owner.
+	// PAD_LOW and PAD_HIGH are set as the owner's padding requires, so
+	// that the payload charged to flow control is that written.
+	pad := data.PaddingLength == 0
+	data.Flags, _ = paddingFlags(data.Flags, data.PaddingLength)
+
+	// Determine how much of the frame we're allowed to send. Empty DATA
+	// isn't subject to flow control, and is padded only from windows
+	// which are open. Note windows may be negative, following a
+	// reduction of SETTINGS_INITIAL_WINDOW_SIZE.
+	bound := c.config.MaxDataPayload
+	if data.PayloadLength() == 0 {
+		if c.sendFlowAvailable < bound {
+			bound = c.sendFlowAvailable
+		}
+		if stream.SendFlowAvailable < bound {
+			bound = stream.SendFlowAvailable
+		}
+	} else {
+
+		if c.sendFlowAvailable <= 0 {
+			// We're stalled on connection flow control. The frame is
+			// parked until WINDOW_UPDATE is recieved.
+			c.writeQueue.enqueueFront(data)
+			if c.writeQueue.stallConnection() {
+				c.config.Events.OnEvent(StallEvent{})
+			}
+			//c.writeQueue.enqueueFront(&BlockedFrame{})
+			return &Error{Code: FLOW_CONTROL_ERROR, Level: RecoverableError,
+				Err: kConnectionStallError}
+		} else if c.sendFlowAvailable < bound {
+			bound = c.sendFlowAvailable
+		}
+
+		if stream.SendFlowAvailable <= 0 {
+			// We're stalled on stream flow control.
+			c.writeQueue.enqueueFront(data)
+			if c.writeQueue.stallStream(stream.ID) {
+				c.config.Events.OnEvent(StallEvent{stream.ID})
+			}
+			//c.writeQueue.enqueueFront(
+			//  &BlockedFrame{FramePrefix{StreamID: data.StreamID}})
+			return &Error{Code: FLOW_CONTROL_ERROR, Level: RecoverableError,
+				Err: kStreamStallError}
+		} else if stream.SendFlowAvailable < bound {
+			bound = stream.SendFlowAvailable
+		}
+
+		// Split the frame if needed, and update flow control state.
+		if bound < data.PayloadLength() {
+			remainder := data.SplitAt(bound)
+			c.writeQueue.enqueueFront(remainder)
+		}
+	}
+	if pad {
+		c.padData(data, bound)
 	}
 
 	// TODO(johng): Compress payload iff a) allowed, b) uncompressed length
@@ -122,13 +950,23 @@ func (c *connection) prepareToSendDataFrame(data *DataFrame) *Error {
 
 	c.sendFlowAvailable -= data.PayloadLength()
 	stream.SendFlowAvailable -= data.PayloadLength()
+	c.writeQueue.charge(stream.ID, data.PayloadLength())
+	stream.send.charge(len(data.Data), data.PayloadLength()-len(data.Data))
 
-	// Inform delegate of window decrease from the send.
-	stream.SendFlowPump <- -data.PayloadLength()
+	// Inform owner of window decrease from the send.
+	if data.PayloadLength() != 0 {
+		stream.events.push(&WindowEvent{
+			Delta:     -data.PayloadLength(),
+			Available: stream.SendFlowAvailable,
+		})
+	}
 
 	// Update stream state.
 	if data.Flags&END_STREAM != 0 {
-		stream.onLocalFin()
+		if err := stream.onLocalFin(DATA); err != nil {
+			return err
+		}
+		stream.send.close()
 	}
 	return nil
 }
@@ -139,69 +977,510 @@ func (c *connection) recieveDataFrame(data *DataFrame) *Error {
 	}
 
 	stream := c.getOrCreateStream(data.StreamID)
-	if err := stream.onData(Receive, data.Flags&END_STREAM != 0); err != nil {
-		c.recvFlow.ApplyDataConsumed(data)
+	if err := stream.onData(Receive, false); err != nil {
+		c.discardData(data)
 		return err
 	}
 	if err := stream.RecvFlow.ApplyDataRecieved(data); err != nil {
-		c.recvFlow.ApplyDataConsumed(data)
+		c.discardData(data)
 		return err
 	}
 
-	if data.Flags&END_STREAM != 0 {
-		stream.onRemoteFin()
+	// DATA is buffered until read by the owner. Padding is never read,
+	// and is consumed immediately, as is DATA of a stream the owner closed.
+	fin := data.Flags&END_STREAM != 0
+	discarded := data.PayloadLength() - len(data.Data)
+	endSegment := data.Flags&END_SEGMENT != 0
+	if !stream.recv.write(data.Data, endSegment, fin) {
+		discarded += len(data.Data)
+	} else if len(data.Data) != 0 {
+		stream.events.push(&DataEvent{Length: len(data.Data)})
+	}
+	if discarded != 0 {
+		c.consume(stream.ID, discarded)
+	}
+	if fin {
+		return stream.onRemoteFin(DATA)
 	}
 	return nil
 }
 
+// Credits the connection or stream send window, resuming DATA which
+// was parked awaiting the update.
+func (c *connection) recieveWindowUpdateFrame(update *WindowUpdateFrame) *Error {
+	delta := int(update.SizeDelta)
+
+	if update.StreamID == 0 {
+		if delta == 0 {
+			return protocolError("connection WINDOW_UPDATE of zero")
+		}
+		if c.sendFlowAvailable+delta > kMaxWindowSize {
+			return flowControlError("connection send window overflow (%v + %v)",
+				c.sendFlowAvailable, delta)
+		}
+		c.sendFlowAvailable += delta
+		if c.sendFlowAvailable > 0 {
+			c.writeQueue.unstallConnection()
+		}
+		return nil
+	}
+
+	stream := c.getOrCreateStream(update.StreamID)
+	if stream.State == Idle {
+		return protocolError("recieved WINDOW_UPDATE on idle stream %v",
+			stream.ID)
+	} else if stream.State == Closed || stream.State == ClosedWithSentReset {
+		// The peer may send WINDOW_UPDATE before learning of the close.
+		return nil
+	}
+	if delta == 0 {
+		err := protocolError("stream %v WINDOW_UPDATE of zero", stream.ID)
+		err.Level = StreamError
+		return err
+	}
+	if err := stream.onSendFlowDelta(delta); err != nil {
+		return err
+	}
+	if stream.SendFlowAvailable > 0 {
+		c.writeQueue.unstallStream(stream.ID)
+	}
+	return nil
+}
+
+// Applies the change of the peer's SETTINGS_INITIAL_WINDOW_SIZE to the
+// send windows of all streams, which may become negative.
+func (c *connection) applyInitialWindowSize(value uint32) *Error {
+	delta := int(value) - int(c.peerSettings[SETTINGS_INITIAL_WINDOW_SIZE])
+
+	for id, stream := range c.streams {
+		if stream.State == Closed || stream.State == ClosedWithSentReset {
+			continue
+		}
+		if err := stream.onSendFlowDelta(delta); err != nil {
+			// Overflow caused by SETTINGS is a connection error.
+			err.Level = ConnectionError
+			return err
+		}
+		if stream.SendFlowAvailable > 0 {
+			c.writeQueue.unstallStream(id)
+		}
+	}
+	return nil
+}
+
+// Applies bytes consumed by the application to the connection and stream
+// receive windows. Bytes of a retired stream, which remained buffered as
+// it closed, are returned to the connection window alone.
+func (c *connection) consume(id StreamID, n int) {
+	// Bytes may not be consumed before they're recieved, lest the peer
+	// be granted window it hasn't earned. Bytes of a reset stream were
+	// released as it was reset.
+	stream, ok := c.streams[id]
+	unconsumed := c.retiredUnconsumed[id]
+	if ok {
+		unconsumed = stream.RecvFlow.Unconsumed()
+	}
+	if n > unconsumed {
+		n = unconsumed
+	}
+	if unconsumed := c.recvFlow.Unconsumed(); n > unconsumed {
+		n = unconsumed
+	}
+	if n == 0 {
+		return
+	}
+	c.recvFlow.ApplyBytesConsumed(n)
+	c.maybeUpdateWindow(0, &c.recvFlow)
+	c.sampleBdp(id, n)
+
+	if !ok {
+		if c.retiredUnconsumed[id] -= n; c.retiredUnconsumed[id] == 0 {
+			delete(c.retiredUnconsumed, id)
+		}
+		return
+	}
+	stream.RecvFlow.ApplyBytesConsumed(n)
+	if stream.State == Open || stream.State == HalfClosedLocal {
+		// The peer may still send DATA.
+		c.maybeUpdateWindow(id, &stream.RecvFlow)
+	}
+}
+
+// Queues a WINDOW_UPDATE of the stream (or the connection, if id is 0)
+// once enough consumed bytes are unacknowledged.
+// Consumes DATA which won't be buffered for any stream, eg because the
+// stream is closed, returning its credit to the connection window.
+func (c *connection) discardData(data *DataFrame) {
+	c.recvFlow.ApplyDataConsumed(data)
+	c.maybeUpdateWindow(0, &c.recvFlow)
+}
+
+func (c *connection) maybeUpdateWindow(id StreamID, flow *RecieveFlow) {
+	if flow.OverUnackedThreshold() {
+		c.writeQueue.enqueueFront(flow.BuildWindowUpdate(id))
+	}
+}
+
+func (c *connection) prepareToSendRstStreamFrame(rst *RstStreamFrame) *Error {
+	stream := c.getOrCreateStream(rst.StreamID)
+	if stream.State == ClosedWithSentReset {
+		// The stream was already reset, eg by both its owner and the
+		// connection. Drop it.
+		return &Error{Code: STREAM_CLOSED, Level: RecoverableError,
+			Err: fmt.Errorf("dropping RST_STREAM of reset stream %v",
+				stream.ID)}
+	}
+	return c.resetStream(stream, Send, &Error{
+		Code:  rst.Error.Code,
+		Level: StreamError,
+		Err: fmt.Errorf("stream %v reset (%v): %v",
+			rst.StreamID, rst.Error.Code, rst.Error.Error()),
+	})
+}
+
+func (c *connection) recieveRstStreamFrame(rst *RstStreamFrame) *Error {
+	stream := c.getOrCreateStream(rst.StreamID)
+	return c.resetStream(stream, Receive, &Error{
+		Code:  rst.Error.Code,
+		Level: StreamError,
+		Err: fmt.Errorf("stream %v reset by peer (%v)",
+			rst.StreamID, rst.Error.Code),
+	})
+}
+
+// Transitions the stream on a sent or recieved RST_STREAM. Frames of the
+// stream which are yet to be written are discarded, and the owner of an
+// unclosed stream is informed of err.
+func (c *connection) resetStream(stream *Stream,
+	dir SendOrReceive, err *Error) *Error {
+
+	wasClosed := stream.State == Closed || stream.State == ClosedWithSentReset
+	if err := stream.onReset(dir, err); err != nil {
+		return err
+	}
+	c.dropStreamFrames(stream.ID)
+
+	// Recieved DATA which won't now be consumed no longer
+	// counts against the connection window.
+	c.recvFlow.ApplyBytesConsumed(stream.RecvFlow.ReleaseUnconsumed())
+	c.maybeUpdateWindow(0, &c.recvFlow)
+
+	if !wasClosed {
+		stream.ErrorPump <- err
+		// The send window fails first, as it's checked by Reset().
+		stream.send.fail(err)
+		stream.recv.fail(err)
+	}
+	return nil
+}
+
+// Discards queued and pending frames of the stream. A pending DATA
+// frame has already been charged to the connection's send window,
+// which is credited.
+func (c *connection) dropStreamFrames(id StreamID) {
+	c.writeQueue.dropStream(id)
+
+	if c.pendingSend == nil || c.pendingSend.GetStreamID() != id {
+		return
+	}
+	if data, ok := c.pendingSend.(*DataFrame); ok {
+		c.sendFlowAvailable += data.PayloadLength()
+		if c.sendFlowAvailable > 0 {
+			c.writeQueue.unstallConnection()
+		}
+	}
+	c.pendingSend = nil
+}
+
 func (c *connection) prepareToSendFrame(frame Frame) *Error {
+	if id := frame.GetStreamID(); c.goAwayRecieved &&
+		c.isLocalID(id) && id > c.peerGoAwayLastID {
+		// The peer will not process this stream. Abandon it if not
+		// already, and drop frames queued by the owner.
+		err := &Error{Code: REFUSED_STREAM, Level: RecoverableError,
+			Err: fmt.Errorf("stream %v not opened: GOAWAY recieved", id)}
+
+		stream := c.getOrCreateStream(id)
+		if stream.State != Closed && stream.State != ClosedWithSentReset {
+			stream.abandon(err)
+		}
+		c.writeQueue.dropStream(id)
+		return err
+	}
+	switch frame.(type) {
+	case *DataFrame, *HeadersFrame:
+		stream := c.getOrCreateStream(frame.GetStreamID())
+		if stream.State == Closed || stream.State == ClosedWithSentReset {
+			// The stream was reset or abandoned before the owner's
+			// frame was written. Drop it.
+			return &Error{Code: STREAM_CLOSED, Level: RecoverableError,
+				Err: fmt.Errorf("dropping %v of closed stream %v",
+					frame.GetType(), stream.ID)}
+		}
+	}
+
 	switch f := frame.(type) {
 	case *DataFrame:
 		return c.prepareToSendDataFrame(f)
 	case *HeadersFrame:
 		return c.prepareToSendHeadersFrame(f)
+	case *RstStreamFrame:
+		return c.prepareToSendRstStreamFrame(f)
+	case *SettingsFrame:
+		return c.prepareToSendSettingsFrame(f)
+	case *PriorityFrame, *GoAwayFrame, *PingFrame, *WindowUpdateFrame:
+		return nil
 	default:
 		return internalError("unknown frame type %v", frame)
 	}
 }
 
+func (c *connection) recievePingFrame(ping *PingFrame) *Error {
+	if ping.Flags&ACK == 0 {
+		c.writeQueue.enqueueFront(&PingFrame{
+			FramePrefix: FramePrefix{Flags: ACK},
+			OpaqueData:  ping.OpaqueData,
+		})
+	} else if ping.OpaqueData == kBdpPingData && c.bdp.pinging {
+		c.tuneRecieveWindows()
+	} else if c.shutdownPing != nil &&
+		c.shutdownPing.OpaqueData == ping.OpaqueData && !c.goAwaySent {
+		// Peer has seen our initial GOAWAY. Send the final one.
+		c.sendGoAway(Error{Code: NO_ERROR})
+	}
+	return nil
+}
+
+func (c *connection) recieveGoAwayFrame(goAway *GoAwayFrame) *Error {
+	if c.goAwayRecieved && goAway.LastID > c.peerGoAwayLastID {
+		return protocolError("GOAWAY LastID increased from %v to %v",
+			c.peerGoAwayLastID, goAway.LastID)
+	}
+	c.handle.mu.Lock()
+	c.handle.peerGoAway = goAway
+	c.handle.mu.Unlock()
+	c.config.Events.OnEvent(GoAwayRecievedEvent{goAway})
+
+	c.goAwayRecieved = true
+	c.peerGoAwayLastID = goAway.LastID
+
+	reason := fmt.Sprintf("GOAWAY %v, last stream %v",
+		goAway.Error.Code, goAway.LastID)
+	if goAway.Error.Err != nil {
+		reason += ": " + goAway.Error.Error()
+	}
+
+	// Locally initiated streams above LastID were never processed by the
+	// peer. Abandon them, informing owners that they may be retried.
+	// As with streams not yet opened (see prepareToSendFrame), no
+	// RST_STREAM is sent. Streams at or below LastID continue to run to
+	// completion.
+	for id, stream := range c.streams {
+		if !c.isLocalID(id) || id <= goAway.LastID || stream.State == Idle ||
+			stream.State == Closed || stream.State == ClosedWithSentReset {
+			continue
+		}
+		c.dropStreamFrames(id)
+		stream.abandon(&Error{Code: REFUSED_STREAM, Level: RecoverableError,
+			Err: fmt.Errorf("stream %v not processed by peer (%v)", id, reason)})
+	}
+	return nil
+}
+
 func (c *connection) recieveFrame(frame Frame) *Error {
+	if id := frame.GetStreamID(); c.goAwaySent && frame.GetType() != PRIORITY &&
+		!c.isLocalID(id) && id > c.goAwayLastID {
+		if _, ok := c.streams[frame.GetStreamID()]; !ok {
+			// Peer opened a stream after our GOAWAY. Ignore it, but still
+			// account for DATA against the connection flow-control window.
+			if data, ok := frame.(*DataFrame); ok {
+				if err := c.recvFlow.ApplyDataRecieved(data); err != nil {
+					return err
+				}
+				c.discardData(data)
+			}
+			return &Error{Code: REFUSED_STREAM, Level: RecoverableError,
+				Err: fmt.Errorf("stream %v opened after GOAWAY (last %v)",
+					frame.GetStreamID(), c.goAwayLastID)}
+		}
+	}
+
 	switch f := frame.(type) {
 	case *DataFrame:
 		return c.recieveDataFrame(f)
 	case *HeadersFrame:
 		return c.recieveHeadersFrame(f)
+	case *PriorityFrame:
+		return c.recievePriorityFrame(f)
+	case *RstStreamFrame:
+		return c.recieveRstStreamFrame(f)
+	case *SettingsFrame:
+		return c.recieveSettingsFrame(f)
+	case *PingFrame:
+		return c.recievePingFrame(f)
+	case *GoAwayFrame:
+		return c.recieveGoAwayFrame(f)
+	case *WindowUpdateFrame:
+		return c.recieveWindowUpdateFrame(f)
+	case *PushPromiseFrame:
+		return c.recievePushPromiseFrame(f)
 	default:
-		return internalError("unknown frame type %v", frame)
+		// CONTINUATION fragments of header blocks aren't yet reassembled
+		// (the parser validates their sequencing), and frames of other
+		// types are ignored.
+		return nil
 	}
 }
 
-func (c *connection) handleError(err *Error, frame Frame) {
-	log.Println("%v error (%v-level): %v", err.Code, err.Level, err)
+// Servers may not recieve PUSH_PROMISE, nor may clients which disabled
+// push. Pushed streams aren't otherwise supported, and are refused.
+func (c *connection) recievePushPromiseFrame(promise *PushPromiseFrame) *Error {
+	if c.isServer {
+		return protocolError("PUSH_PROMISE recieved by server")
+	} else if c.localSettings[SETTINGS_ENABLE_PUSH] == 0 {
+		return protocolError("PUSH_PROMISE recieved with push disabled")
+	} else if c.isLocalID(promise.PromisedID) {
+		return protocolError("PUSH_PROMISE of local stream %v",
+			promise.PromisedID)
+	}
+	stream := c.getOrCreateStream(promise.PromisedID)
+	if err := stream.onPushPromise(Receive); err != nil {
+		return err
+	}
+	c.writeQueue.enqueueFront(&RstStreamFrame{
+		FramePrefix{StreamID: promise.PromisedID},
+		Error{Code: REFUSED_STREAM},
+	})
+	return nil
+}
 
+func (c *connection) handleError(err *Error, frame Frame) {
 	if err.Level == StreamError {
+		c.config.Events.OnEvent(StreamErrorEvent{frame.GetStreamID(), err})
 		c.writeQueue.enqueueFront(
 			&RstStreamFrame{
 				FramePrefix{StreamID: frame.GetStreamID()},
 				*err,
 			})
 	} else if err.Level == ConnectionError {
-		c.writeQueue.enqueueFront(
-			&GoAwayFrame{
-				LastID: 0, // TODO(johng): Report last stream.
-				Error:  *err,
-			})
+		c.config.Events.OnEvent(ConnectionErrorEvent{err})
+		if c.fatalGoAway != nil {
+			// Only the first error is sent. The connection closes
+			// once its GOAWAY is written.
+			return
+		}
+		c.goAwaySent = true
+		c.goAwayLastID = c.lastRemoteID
+		c.fatalGoAway = &GoAwayFrame{
+			LastID: c.goAwayLastID,
+			Error:  *err,
+		}
+		c.writeQueue.enqueueFront(c.fatalGoAway)
+	} else {
+		// The frame was ignored or dropped.
+		c.config.Events.OnEvent(StreamErrorEvent{frame.GetStreamID(), err})
 	}
 }
 
 func (c *connection) getOrCreateStream(id StreamID) *Stream {
 	stream, ok := c.streams[id]
 	if !ok {
-		// TODO(johng): Fill this out.
-		stream = &Stream{
-			ID: id,
+		var handle *StreamHandle
+		stream, handle = newStream(id,
+			int(c.peerSettings[SETTINGS_INITIAL_WINDOW_SIZE]),
+			c.recvInitialWindow)
+
+		// Re-create a retired stream in its closed state. A stream
+		// which isn't retained, but may have been evicted, is Closed.
+		if state, ok := c.closedStreams.lookup(id); ok {
+			stream.State = state
+			// Bytes which remain buffered for the owner are restored,
+			// until the stream is again retired.
+			stream.RecvFlow.WinUsed = c.retiredUnconsumed[id]
+			delete(c.retiredUnconsumed, id)
+		} else if c.closedStreams.mayHaveEvicted(id) && c.wasOpened(id) {
+			stream.State = Closed
+		} else if !c.isLocalID(id) {
+			// The handle is held until the peer opens the stream.
+			handle.conn = c.handle
+			stream.owner = handle
 		}
-		c.streams[id] = stream
+		c.addStream(stream)
 	}
 	return stream
 }
+
+// Adds the stream to the connection, which counts its state.
+func (c *connection) addStream(stream *Stream) {
+	c.instrumentStream(stream)
+	stream.counts = &c.counts
+	c.counts.add(stream)
+	c.streams[stream.ID] = stream
+}
+
+// Moves closed streams from streams to closedStreams. Recieved bytes
+// which remain buffered for the owner continue to count against the
+// connection window, until they're read or discarded.
+func (c *connection) retireClosedStreams() {
+	if len(c.counts.closed) == 0 {
+		return
+	}
+	for _, id := range c.counts.closed {
+		stream := c.streams[id]
+		if n := stream.RecvFlow.Unconsumed(); n != 0 {
+			c.retiredUnconsumed[id] = n
+		}
+		c.closedStreams.add(id, stream.State)
+		delete(c.streams, id)
+		c.writeQueue.retireStream(id)
+	}
+	c.counts.closed = c.counts.closed[:0]
+}
+
+// Whether the stream has been opened (or implicitly closed) by
+// either endpoint. Streams which haven't are idle.
+func (c *connection) wasOpened(id StreamID) bool {
+	if id == 0 {
+		return false
+	} else if c.isLocalID(id) {
+		return id < c.nextLocalID
+	}
+	return id <= c.lastRemoteID
+}
+
+// Builds an Idle stream having the send and recieve windows, and an
+// owner's handle to it. The pump is buffered to avoid blocking on a
+// slow (or absent) owner.
+func newStream(id StreamID, sendWindow,
+	recvWindow int) (*Stream, *StreamHandle) {
+
+	errorPump := make(chan *Error, 1)
+	recv, send := newRecvBuffer(), newSendWindow(sendWindow)
+	events := newStreamEvents()
+
+	stream := &Stream{
+		ID:                id,
+		RecvFlow:          RecieveFlow{WinSize: recvWindow},
+		SendFlowAvailable: sendWindow,
+		ErrorPump:         errorPump,
+		recv:              recv,
+		send:              send,
+		events:            events,
+	}
+	handle := &StreamHandle{
+		ID:        id,
+		ErrorPump: errorPump,
+		recv:      recv,
+		send:      send,
+		events:    events,
+
+		readDeadline:  newStreamDeadline(),
+		writeDeadline: newStreamDeadline(),
+	}
+	return stream, handle
+}
+
+// Whether the StreamID is of a stream initiated by this endpoint.
+func (c *connection) isLocalID(id StreamID) bool {
+	return (id%2 == 0) == c.isServer
+}
@@ -0,0 +1,1149 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type fakeTransport struct {
+	closed chan struct{}
+}
+
+func (t *fakeTransport) Close() error {
+	close(t.closed)
+	return nil
+}
+
+// Fails if goroutines of the package remain running, once given a
+// moment to exit.
+func checkNoLeakedGoroutines(c *gc.C) {
+	var leaked []string
+	for deadline := time.Now().Add(time.Second); ; {
+		leaked = leaked[:0]
+
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		for _, stack := range strings.Split(string(buf), "\n\n") {
+			if strings.Contains(stack, "gohttp2.(*connection)") ||
+				strings.Contains(stack, "gohttp2.(*Connection)") ||
+				strings.Contains(stack, "gohttp2.(*StreamHandle)") {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, stack := range leaked {
+		c.Error("leaked goroutine: ", stack)
+	}
+}
+
+type ConnectionTest struct {
+	recvMux   chan Frame
+	sendMux   chan Frame
+	transport *fakeTransport
+
+	cancel  context.CancelFunc
+	handle  *Connection
+	conn    *connection
+	started bool
+}
+
+func (t *ConnectionTest) SetUpTest(c *gc.C) {
+	t.setUp(true)
+}
+
+func (t *ConnectionTest) setUp(isServer bool) {
+	var ctx context.Context
+	ctx, t.cancel = context.WithCancel(context.Background())
+
+	t.recvMux = make(chan Frame)
+	t.sendMux = make(chan Frame)
+	t.transport = &fakeTransport{closed: make(chan struct{})}
+	config, err := resolveConfig(nil)
+	if err != nil {
+		panic(err)
+	}
+	t.handle, t.conn = newConnection(ctx, config, isServer,
+		t.transport, t.recvMux, t.sendMux)
+	t.started = false
+}
+
+// Cancels the connection, and verifies that its goroutines exit.
+func (t *ConnectionTest) TearDownTest(c *gc.C) {
+	t.cancel()
+	if t.started {
+		t.expectClosed(c)
+	}
+	checkNoLeakedGoroutines(c)
+}
+
+// Adds a stream having owner events and pump, which are returned.
+func (t *ConnectionTest) addStream(id StreamID,
+	state StreamState) (*streamEvents, chan *Error) {
+
+	events, errorPump := newStreamEvents(), make(chan *Error, 1)
+	t.conn.addStream(&Stream{
+		ID:        id,
+		State:     state,
+		ErrorPump: errorPump,
+		recv:      newRecvBuffer(),
+		send:      newSendWindow(0),
+		events:    events,
+	})
+	return events, errorPump
+}
+
+// Adds a stream having the recieve window, and returns its owner's handle.
+// The stream's HEADERS are taken to have been sent.
+func (t *ConnectionTest) addOwnedStream(id StreamID, state StreamState,
+	window int) *StreamHandle {
+
+	stream, handle := newStream(id,
+		int(kSettingDefaults[SETTINGS_INITIAL_WINDOW_SIZE]), window)
+	stream.State = state
+	handle.conn = t.handle
+	handle.send.sendHeaders()
+	t.conn.addStream(stream)
+	return handle
+}
+
+// State of an open or retired stream. Must be called after
+// a synchronizing send or recieve with mainLoop().
+func (t *ConnectionTest) streamState(id StreamID) StreamState {
+	if stream, ok := t.conn.streams[id]; ok {
+		return stream.State
+	}
+	state, ok := t.conn.closedStreams.lookup(id)
+	if !ok {
+		panic(id)
+	}
+	return state
+}
+
+// Starts mainLoop(), and consumes the initial SETTINGS
+// (and any WINDOW_UPDATE) which it sends.
+func (t *ConnectionTest) start() {
+	t.started = true
+	initial := len(t.conn.writeQueue.frames)
+	go t.conn.mainLoop()
+
+	for i := 0; i < initial; i++ {
+		select {
+		case <-t.sendMux:
+		case <-time.After(time.Second):
+			panic("timeout waiting for initial SETTINGS")
+		}
+	}
+}
+
+func (t *ConnectionTest) shutdown(ctx context.Context) <-chan error {
+	result := make(chan error, 1)
+	go func() { result <- t.handle.Shutdown(ctx) }()
+	return result
+}
+
+func (t *ConnectionTest) expectSent(c *gc.C) Frame {
+	select {
+	case frame := <-t.sendMux:
+		return frame
+	case <-time.After(time.Second):
+		c.Fatal("timeout waiting for sent frame")
+	}
+	return nil
+}
+
+func (t *ConnectionTest) expectError(c *gc.C, pump <-chan *Error) *Error {
+	select {
+	case err := <-pump:
+		return err
+	case <-time.After(time.Second):
+		c.Fatal("timeout waiting for stream error")
+	}
+	return nil
+}
+
+func (t *ConnectionTest) expectEvent(c *gc.C, events *streamEvents) StreamEvent {
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(time.Second, func() { close(timeout) })
+	defer timer.Stop()
+
+	event, ok := events.next(timeout)
+	if !ok {
+		c.Fatal("timeout waiting for stream event")
+	}
+	return event
+}
+
+// Expects a WindowEvent of the stream, and returns its delta.
+func (t *ConnectionTest) expectWindowDelta(c *gc.C, events *streamEvents) int {
+	event := t.expectEvent(c, events)
+	c.Assert(event, gc.FitsTypeOf, &WindowEvent{})
+	return event.(*WindowEvent).Delta
+}
+
+func (t *ConnectionTest) expectClosed(c *gc.C) {
+	select {
+	case <-t.handle.Done():
+	case <-time.After(time.Second):
+		c.Fatal("timeout waiting for connection close")
+	}
+	select {
+	case <-t.transport.closed:
+	default:
+		c.Error("transport not closed")
+	}
+}
+
+func (t *ConnectionTest) TestShutdownWithNoStreams(c *gc.C) {
+	t.start()
+	result := t.shutdown(context.Background())
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.LastID, gc.Equals, StreamID(0))
+	c.Check(goAway.Error.Code, gc.Equals, NO_ERROR)
+
+	t.expectClosed(c)
+	c.Check(<-result, gc.IsNil)
+	c.Check(t.handle.Err(), gc.IsNil)
+}
+
+func (t *ConnectionTest) TestShutdownWaitsForOpenStreams(c *gc.C) {
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3}}
+	result := t.shutdown(context.Background())
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.LastID, gc.Equals, StreamID(3))
+
+	// A stream opened by the peer after GOAWAY is ignored.
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 5}}
+	t.recvMux <- &DataFrame{FramePrefix: FramePrefix{StreamID: 5}}
+
+	// Complete stream 3. The transport is then closed.
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 3, Flags: END_STREAM}}
+	t.handle.queueMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 3, Flags: END_STREAM}}
+
+	headers := t.expectSent(c).(*HeadersFrame)
+	c.Check(headers.StreamID, gc.Equals, StreamID(3))
+
+	t.expectClosed(c)
+	c.Check(<-result, gc.IsNil)
+}
+
+func (t *ConnectionTest) TestTwoPhaseShutdown(c *gc.C) {
+	t.conn.config.TwoPhaseShutdown = true
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3,
+		Flags: END_STREAM}}
+	result := t.shutdown(context.Background())
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.LastID, gc.Equals, kMaxStreamID)
+	ping := t.expectSent(c).(*PingFrame)
+	c.Check(ping.Flags&ACK, gc.Equals, NO_FLAGS)
+
+	// Stream 5 was opened by the peer prior to seeing the initial GOAWAY.
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 5,
+		Flags: END_STREAM}}
+	t.recvMux <- &PingFrame{
+		FramePrefix: FramePrefix{Flags: ACK},
+		OpaqueData:  ping.OpaqueData,
+	}
+
+	goAway = t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.LastID, gc.Equals, StreamID(5))
+
+	// Complete local halves of streams 3 & 5.
+	for _, id := range []StreamID{3, 5} {
+		t.handle.queueMux <- &HeadersFrame{
+			FramePrefix: FramePrefix{StreamID: id, Flags: END_STREAM}}
+		c.Check(t.expectSent(c).GetStreamID(), gc.Equals, id)
+	}
+	t.expectClosed(c)
+	c.Check(<-result, gc.IsNil)
+}
+
+func (t *ConnectionTest) TestContextCancellationClosesConnection(c *gc.C) {
+	t.setUp(false)
+	t.conn.peerSettings[SETTINGS_MAX_CONCURRENT_STREAMS] = 1
+	t.start()
+
+	stream, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Assert(err, gc.IsNil)
+	t.expectSent(c)
+	c.Check(t.expectWindowDelta(c, stream.events), gc.Equals, 65535)
+
+	// A second open is blocked on the peer's concurrency limit.
+	blocked := make(chan *Error)
+	go func() {
+		_, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+		blocked <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	t.cancel()
+	t.expectClosed(c)
+
+	c.Check(t.handle.Err().Code, gc.Equals, CANCEL)
+	c.Check(errors.Is(t.handle.Err(), context.Canceled), gc.Equals, true)
+
+	// The open stream and blocked open are failed.
+	streamErr := t.expectError(c, stream.ErrorPump)
+	c.Check(streamErr.Code, gc.Equals, CANCEL)
+	c.Check(errors.Is(streamErr, context.Canceled), gc.Equals, true)
+	reset := t.expectEvent(c, stream.events).(*ResetEvent)
+	c.Check(reset.Err, gc.Equals, streamErr)
+	c.Check(t.expectEvent(c, stream.events), gc.FitsTypeOf, &ClosedEvent{})
+	c.Check(<-blocked, gc.NotNil)
+
+	// The write loop is signaled to exit.
+	_, ok := <-t.sendMux
+	c.Check(ok, gc.Equals, false)
+}
+
+func (t *ConnectionTest) TestClosedRecvMuxClosesConnection(c *gc.C) {
+	events, errs := t.addStream(1, Open)
+	t.start()
+
+	close(t.recvMux)
+	t.expectClosed(c)
+
+	c.Check(t.handle.Err().Code, gc.Equals, CANCEL)
+	c.Check(errors.Is(t.handle.Err(), io.EOF), gc.Equals, true)
+
+	// The open stream is failed.
+	streamErr := t.expectError(c, errs)
+	c.Check(errors.Is(streamErr, io.EOF), gc.Equals, true)
+	c.Check(t.expectEvent(c, events), gc.FitsTypeOf, &ResetEvent{})
+	c.Check(t.expectEvent(c, events), gc.FitsTypeOf, &ClosedEvent{})
+}
+
+func (t *ConnectionTest) TestConnectionErrorClosesConnection(c *gc.C) {
+	_, errors := t.addStream(1, Open)
+	t.start()
+
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 3}, SizeDelta: 1}
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+
+	// The connection closes once GOAWAY is written, despite open streams.
+	t.expectClosed(c)
+	c.Check(t.handle.Err().Code, gc.Equals, PROTOCOL_ERROR)
+
+	err := t.expectError(c, errors)
+	c.Check(err.Code, gc.Equals, PROTOCOL_ERROR)
+	c.Check(err.Level, gc.Equals, ConnectionError)
+}
+
+func (t *ConnectionTest) TestPingIsAcknowledged(c *gc.C) {
+	t.start()
+	t.recvMux <- &PingFrame{OpaqueData: 0x1234}
+
+	ping := t.expectSent(c).(*PingFrame)
+	c.Check(ping.Flags, gc.Equals, ACK)
+	c.Check(ping.OpaqueData, gc.Equals, uint64(0x1234))
+}
+
+func (t *ConnectionTest) TestRecievePushPromiseRefused(c *gc.C) {
+	t.setUp(false)
+	t.addStream(1, HalfClosedLocal)
+	t.start()
+
+	// CONTINUATION is ignored, rather than failing the connection.
+	t.recvMux <- &ContinuationFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &PushPromiseFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		PromisedID:  2,
+	}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(2))
+	c.Check(rst.Error.Code, gc.Equals, REFUSED_STREAM)
+	t.syncLoop(c)
+	c.Check(t.streamState(2), gc.Equals, ClosedWithSentReset)
+}
+
+func (t *ConnectionTest) TestServerRecievesPushPromise(c *gc.C) {
+	t.start()
+	t.recvMux <- &PushPromiseFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		PromisedID:  2,
+	}
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestShutdownContextExpires(c *gc.C) {
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result := t.shutdown(ctx)
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.LastID, gc.Equals, StreamID(1))
+
+	// Stream 1 never completes.
+	t.expectClosed(c)
+	c.Check(<-result, gc.Equals, context.DeadlineExceeded)
+}
+
+func (t *ConnectionTest) TestShutdownOfFailedConnection(c *gc.C) {
+	t.start()
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 3}, SizeDelta: 1}
+	c.Check(t.expectSent(c).(*GoAwayFrame).Error.Code, gc.Equals,
+		PROTOCOL_ERROR)
+	t.expectClosed(c)
+
+	err := <-t.shutdown(context.Background())
+	c.Check(err.(*Error).Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestOnlyFirstConnectionErrorIsSent(c *gc.C) {
+	t.start()
+
+	// A written frame is pending as errors occur.
+	t.handle.queueMux <- &PingFrame{}
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 3}, SizeDelta: 1}
+	t.recvMux <- &SettingsFrame{Settings: map[SettingID]uint32{
+		SETTINGS_INITIAL_WINDOW_SIZE: kMaxWindowSize + 1}}
+
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.expectSent(c).(*GoAwayFrame).Error.Code, gc.Equals,
+		PROTOCOL_ERROR)
+	t.expectClosed(c)
+	c.Check(t.handle.Err().Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestPeerGoAwayAbandonsUnprocessedStreams(c *gc.C) {
+	t.setUp(false)
+	t.addStream(1, HalfClosedLocal)
+	_, errors3 := t.addStream(3, Open)
+	_, errors5 := t.addStream(5, HalfClosedLocal)
+	t.start()
+
+	c.Check(t.handle.PeerGoAway(), gc.IsNil)
+	t.recvMux <- &GoAwayFrame{
+		LastID: 1,
+		Error:  *NewError(ENHANCE_YOUR_CALM, "debug data"),
+	}
+
+	for _, pump := range []chan *Error{errors3, errors5} {
+		err := t.expectError(c, pump)
+		c.Check(err.Retryable(), gc.Equals, true)
+		c.Check(err.Level, gc.Equals, RecoverableError)
+		c.Check(err, gc.ErrorMatches, "stream \\d not processed by peer "+
+			"\\(GOAWAY ENHANCE_YOUR_CALM, last stream 1: debug data\\)")
+	}
+	goAway := t.handle.PeerGoAway()
+	c.Check(goAway.LastID, gc.Equals, StreamID(1))
+	c.Check(goAway.Error.Code, gc.Equals, ENHANCE_YOUR_CALM)
+	c.Check(goAway.Error.Error(), gc.Equals, "debug data")
+
+	// Stream 1 runs to completion, after which the connection closes.
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM}}
+	t.expectClosed(c)
+}
+
+func (t *ConnectionTest) TestNoNewStreamsAfterPeerGoAway(c *gc.C) {
+	t.setUp(false)
+	t.addStream(1, Open)
+	_, errors3 := t.addStream(3, Idle)
+	t.start()
+
+	t.recvMux <- &GoAwayFrame{LastID: 1}
+	t.handle.queueMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3}}
+	t.handle.queueMux <- &DataFrame{FramePrefix: FramePrefix{StreamID: 3}}
+
+	err := t.expectError(c, errors3)
+	c.Check(err.Retryable(), gc.Equals, true)
+	c.Check(err.Level, gc.Equals, RecoverableError)
+	c.Check(err, gc.ErrorMatches, "stream 3 not opened: GOAWAY recieved")
+
+	// Stream 1 is uneffected.
+	t.handle.queueMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	c.Check(t.expectSent(c).GetStreamID(), gc.Equals, StreamID(1))
+}
+
+func (t *ConnectionTest) TestPeerGoAwayLastIDMayNotIncrease(c *gc.C) {
+	t.setUp(false)
+	t.addStream(1, Open)
+	t.start()
+	t.recvMux <- &GoAwayFrame{LastID: kMaxStreamID}
+	t.recvMux <- &GoAwayFrame{LastID: 7}
+	t.recvMux <- &GoAwayFrame{LastID: 9}
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+	c.Check(t.handle.PeerGoAway().LastID, gc.Equals, StreamID(7))
+}
+
+func (t *ConnectionTest) TestRecieveRstStream(c *gc.C) {
+	events, errors := t.addStream(1, Open)
+	t.conn.sendFlowAvailable = 100
+	t.conn.streams[1].SendFlowAvailable = 100
+	t.start()
+
+	// DATA is prepared and charged to flow control, but not yet written.
+	t.handle.queueMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        []byte("0123456789"),
+	}
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, -10)
+
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL, Level: StreamError},
+	}
+	err := t.expectError(c, errors)
+	c.Check(err.Code, gc.Equals, CANCEL)
+	c.Check(err, gc.ErrorMatches, "stream 1 reset by peer \\(CANCEL\\)")
+
+	c.Check(t.expectEvent(c, events).(*ResetEvent).Err, gc.Equals, err)
+	c.Check(t.expectEvent(c, events), gc.FitsTypeOf, &ClosedEvent{})
+
+	// Pending DATA was discarded, and its flow-control credit returned.
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.conn.sendFlowAvailable, gc.Equals, 100)
+	c.Check(t.streamState(1), gc.Equals, Closed)
+}
+
+func (t *ConnectionTest) TestRecieveRstStreamReleasesRecieveWindow(c *gc.C) {
+	t.addStream(1, Open)
+	t.conn.recvFlow.WinSize = 100
+	t.conn.streams[1].RecvFlow.WinSize = 100
+	t.start()
+
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        []byte("0123456789"),
+	}
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL, Level: StreamError},
+	}
+	t.handle.queueMux <- &PingFrame{}
+	t.expectSent(c)
+
+	c.Check(t.conn.recvFlow.WinUsed, gc.Equals, 10)
+	c.Check(t.conn.recvFlow.WinUnacked, gc.Equals, 10)
+}
+
+func (t *ConnectionTest) TestConsumeEmitsWindowUpdates(c *gc.C) {
+	t.addStream(1, Open)
+	t.conn.recvFlow.WinSize = 200
+	t.conn.streams[1].RecvFlow.WinSize = 100
+	t.start()
+
+	recieveAndConsume := func() {
+		t.recvMux <- &DataFrame{
+			FramePrefix: FramePrefix{StreamID: 1},
+			Data:        make([]byte, 60),
+		}
+		t.handle.consume(1, 60)
+	}
+
+	// Over half of the stream window is consumed, but not the connection's.
+	recieveAndConsume()
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(1))
+	c.Check(update.SizeDelta, gc.Equals, uint32(60))
+
+	recieveAndConsume()
+	update = t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(1))
+	c.Check(update.SizeDelta, gc.Equals, uint32(60))
+	update = t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(0))
+	c.Check(update.SizeDelta, gc.Equals, uint32(120))
+
+	c.Check(t.conn.recvFlow.WinUsed, gc.Equals, 0)
+	c.Check(t.conn.streams[1].RecvFlow.WinUsed, gc.Equals, 0)
+}
+
+func (t *ConnectionTest) TestConsumeIsBoundedByRecievedBytes(c *gc.C) {
+	t.addStream(1, Open)
+	t.conn.recvFlow.WinSize = 100
+	t.conn.streams[1].RecvFlow.WinSize = 100
+	t.start()
+
+	c.Check(t.handle.consume(1, -1), gc.ErrorMatches,
+		"negative consumed bytes -1 of stream 1")
+
+	// Consumption beyond the recieved bytes isn't returned to the peer.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 60),
+	}
+	c.Check(t.handle.consume(1, 1000), gc.IsNil)
+	for i := 0; i != 2; i++ {
+		c.Check(t.expectSent(c).(*WindowUpdateFrame).SizeDelta,
+			gc.Equals, uint32(60))
+	}
+	t.syncLoop(c)
+	c.Check(t.conn.recvFlow.WinUsed, gc.Equals, 0)
+	c.Check(t.conn.streams[1].RecvFlow.WinUsed, gc.Equals, 0)
+}
+
+func (t *ConnectionTest) TestDataOfResetStreamUpdatesWindow(c *gc.C) {
+	t.addStream(1, Open)
+	t.conn.recvFlow.WinSize = 100
+	t.conn.streams[1].RecvFlow.WinSize = 100
+	t.start()
+
+	t.handle.queueMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL}}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &RstStreamFrame{})
+
+	// DATA sent by the peer before it saw the reset is discarded, but
+	// still returned to the connection window.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 90),
+	}
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(0))
+	c.Check(update.SizeDelta, gc.Equals, uint32(90))
+	t.syncLoop(c)
+	c.Check(t.conn.recvFlow.WinUsed, gc.Equals, 0)
+}
+
+func (t *ConnectionTest) TestClosedStreamBufferCountsAgainstWindow(c *gc.C) {
+	t.addStream(1, Open)
+	t.conn.recvFlow.WinSize = 100
+	t.conn.streams[1].RecvFlow.WinSize = 100
+	t.start()
+
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Data:        make([]byte, 60),
+	}
+	t.handle.queueMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM}}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &DataFrame{})
+
+	// Bytes buffered for the owner still count against the connection
+	// window once the stream closes and is retired.
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.streamState(1), gc.Equals, Closed)
+	c.Check(t.conn.recvFlow.Unconsumed(), gc.Equals, 60)
+
+	// They're released as the owner reads them.
+	t.handle.consume(1, 100)
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(0))
+	c.Check(update.SizeDelta, gc.Equals, uint32(60))
+
+	// Further consumption of the stream is ignored.
+	t.handle.consume(1, 60)
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.conn.retiredUnconsumed, gc.HasLen, 0)
+}
+
+func (t *ConnectionTest) TestSendRstStream(c *gc.C) {
+	events, errors := t.addStream(1, Open)
+	t.start()
+
+	t.handle.queueMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL},
+	}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.Error.Code, gc.Equals, CANCEL)
+
+	err := t.expectError(c, errors)
+	c.Check(err.Code, gc.Equals, CANCEL)
+	c.Check(t.expectEvent(c, events).(*ResetEvent).Err, gc.Equals, err)
+	c.Check(t.expectEvent(c, events), gc.FitsTypeOf, &ClosedEvent{})
+
+	// Further frames of the peer are ignored, and frames of the owner dropped.
+	t.recvMux <- &DataFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.handle.queueMux <- &DataFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.streamState(1), gc.Equals, ClosedWithSentReset)
+}
+
+func (t *ConnectionTest) TestStreamErrorSendsRstStream(c *gc.C) {
+	_, errors := t.addStream(1, HalfClosedLocal)
+	t.start()
+
+	// Closes stream 1. A following HEADERS is a stream error.
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, STREAM_CLOSED)
+
+	// The stream closed normally, so its owner isn't notified.
+	select {
+	case err := <-errors:
+		c.Error("unexpected stream error ", err)
+	default:
+	}
+}
+
+func (t *ConnectionTest) TestOpenStreamAllocatesIDs(c *gc.C) {
+	for _, isServer := range []bool{false, true} {
+		t.setUp(isServer)
+		t.start()
+
+		first, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+		c.Check(err, gc.IsNil)
+		second, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+		c.Check(err, gc.IsNil)
+
+		if isServer {
+			c.Check(first.ID, gc.Equals, StreamID(2))
+			c.Check(second.ID, gc.Equals, StreamID(4))
+		} else {
+			c.Check(first.ID, gc.Equals, StreamID(1))
+			c.Check(second.ID, gc.Equals, StreamID(3))
+		}
+		// HEADERS are written in StreamID order.
+		c.Check(t.expectSent(c).GetStreamID(), gc.Equals, first.ID)
+		c.Check(t.expectSent(c).GetStreamID(), gc.Equals, second.ID)
+
+		// Owners are informed of the opened stream's send window.
+		c.Check(t.expectWindowDelta(c, first.events), gc.Equals, 65535)
+		c.Check(t.expectWindowDelta(c, second.events), gc.Equals, 65535)
+
+		t.cancel()
+		t.expectClosed(c)
+	}
+}
+
+func (t *ConnectionTest) TestOpenStreamIDExhaustion(c *gc.C) {
+	t.setUp(false)
+	t.conn.nextLocalID = kMaxStreamID
+	t.start()
+
+	handle, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Check(err, gc.IsNil)
+	c.Check(handle.ID, gc.Equals, kMaxStreamID)
+	c.Check(t.expectSent(c).GetStreamID(), gc.Equals, kMaxStreamID)
+
+	_, err = t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Check(err.Retryable(), gc.Equals, true)
+	c.Check(err.Err, gc.Equals, kStreamIDsExhaustedError)
+
+	// The connection begins to shut down.
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &GoAwayFrame{})
+}
+
+func (t *ConnectionTest) TestOpenStreamAfterGoAway(c *gc.C) {
+	t.setUp(false)
+	t.addStream(1, Open)
+	t.start()
+
+	t.recvMux <- &GoAwayFrame{LastID: 1}
+	_, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Check(err.Retryable(), gc.Equals, true)
+	c.Check(err.Err, gc.Equals, kConnectionGoAwayRecieved)
+}
+
+func (t *ConnectionTest) TestOpenStreamAfterClose(c *gc.C) {
+	t.start()
+	result := t.shutdown(context.Background())
+	t.expectSent(c)
+	<-result
+
+	_, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Check(err.Retryable(), gc.Equals, true)
+	c.Check(err.Err, gc.Equals, kConnectionClosedError)
+}
+
+func (t *ConnectionTest) TestPeerOpensStreamOfLocalParity(c *gc.C) {
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 2}}
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+	c.Check(goAway.Error.Error(), gc.Equals,
+		"peer opened stream 2 of local parity")
+}
+
+func (t *ConnectionTest) TestPeerOpensStreamZero(c *gc.C) {
+	t.start()
+	t.recvMux <- &HeadersFrame{}
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestPeerOpensStreamBelowLastOpened(c *gc.C) {
+	t.start()
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 5}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3}}
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.LastID, gc.Equals, StreamID(5))
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+	c.Check(goAway.Error.Error(), gc.Equals,
+		"peer opened stream 3, but last opened was 5")
+}
+
+func (t *ConnectionTest) TestPeerOpenImplicitlyClosesIdleStreams(c *gc.C) {
+	t.addStream(3, Idle)
+	t.addStream(7, Idle)
+	t.start()
+
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 5}}
+	t.handle.queueMux <- &PingFrame{}
+	t.expectSent(c)
+
+	c.Check(t.streamState(3), gc.Equals, Closed)
+	c.Check(t.streamState(5), gc.Equals, Open)
+	c.Check(t.streamState(7), gc.Equals, Idle)
+}
+
+func (t *ConnectionTest) TestSendHeadersOfUnopenedStream(c *gc.C) {
+	t.start()
+	t.handle.queueMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 2}}
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, INTERNAL_ERROR)
+}
+
+func (t *ConnectionTest) TestPeerExceedsMaxConcurrentStreams(c *gc.C) {
+	t.start()
+	t.handle.queueMux <- &SettingsFrame{
+		Settings: map[SettingID]uint32{SETTINGS_MAX_CONCURRENT_STREAMS: 1}}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &SettingsFrame{})
+
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3}}
+
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(3))
+	c.Check(rst.Error.Code, gc.Equals, REFUSED_STREAM)
+
+	// Once stream 1 closes, stream 5 may be opened.
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL},
+	}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 5}}
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.streamState(5), gc.Equals, Open)
+}
+
+func (t *ConnectionTest) TestSettingsAreAcknowledged(c *gc.C) {
+	t.start()
+	t.recvMux <- &SettingsFrame{
+		Settings: map[SettingID]uint32{SETTINGS_MAX_CONCURRENT_STREAMS: 7}}
+
+	settings := t.expectSent(c).(*SettingsFrame)
+	c.Check(settings.Flags, gc.Equals, ACK)
+	c.Check(t.conn.peerSettings[SETTINGS_MAX_CONCURRENT_STREAMS],
+		gc.Equals, uint32(7))
+}
+
+func (t *ConnectionTest) TestOpenStreamWaitsForCapacity(c *gc.C) {
+	t.setUp(false)
+	t.start()
+	t.recvMux <- &SettingsFrame{
+		Settings: map[SettingID]uint32{SETTINGS_MAX_CONCURRENT_STREAMS: 1}}
+	t.expectSent(c) // SETTINGS ACK.
+
+	first, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Check(err, gc.IsNil)
+	t.expectSent(c)
+
+	opened := make(chan *StreamHandle)
+	go func() {
+		second, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+		c.Check(err, gc.IsNil)
+		opened <- second
+	}()
+
+	// Second open is blocked until the first stream closes.
+	select {
+	case <-opened:
+		c.Fatal("stream opened beyond peer's limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: first.ID},
+		Error:       Error{Code: CANCEL},
+	}
+	c.Check((<-opened).ID, gc.Equals, StreamID(3))
+	c.Check(t.expectSent(c).GetStreamID(), gc.Equals, StreamID(3))
+}
+
+func (t *ConnectionTest) TestOpenStreamContextExpires(c *gc.C) {
+	t.setUp(false)
+	t.conn.peerSettings[SETTINGS_MAX_CONCURRENT_STREAMS] = 0
+	t.start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := t.handle.OpenStream(ctx, &HeadersFrame{})
+	c.Check(err.Code, gc.Equals, CANCEL)
+	c.Check(err.Err, gc.Equals, context.DeadlineExceeded)
+
+	// Pending opens fail on GOAWAY.
+	result := make(chan *Error)
+	go func() {
+		_, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	t.recvMux <- &GoAwayFrame{}
+
+	err = <-result
+	c.Check(err.Retryable(), gc.Equals, true)
+}
+
+func (t *ConnectionTest) TestClosedStreamsAreRetired(c *gc.C) {
+	t.conn.closedStreams.capacity = 4
+	t.start()
+
+	for id := StreamID(1); id <= 19; id += 2 {
+		t.recvMux <- &HeadersFrame{
+			FramePrefix: FramePrefix{StreamID: id, Flags: END_STREAM}}
+		t.handle.queueMux <- &RstStreamFrame{
+			FramePrefix: FramePrefix{StreamID: id},
+			Error:       Error{Code: CANCEL},
+		}
+		t.expectSent(c)
+	}
+	t.handle.queueMux <- &PingFrame{}
+	t.expectSent(c)
+
+	c.Check(t.conn.streams, gc.HasLen, 0)
+	c.Check(t.conn.closedStreams.order, gc.DeepEquals,
+		[]StreamID{13, 15, 17, 19})
+}
+
+func (t *ConnectionTest) TestLateFramesOfRetiredStreams(c *gc.C) {
+	t.conn.closedStreams.capacity = 1
+	t.start()
+
+	for _, id := range []StreamID{1, 3} {
+		t.recvMux <- &HeadersFrame{
+			FramePrefix: FramePrefix{StreamID: id, Flags: END_STREAM}}
+		t.handle.queueMux <- &RstStreamFrame{
+			FramePrefix: FramePrefix{StreamID: id},
+			Error:       Error{Code: CANCEL},
+		}
+		t.expectSent(c)
+	}
+
+	// Stream 3 is retained. DATA following our reset is ignored.
+	t.recvMux <- &DataFrame{FramePrefix: FramePrefix{StreamID: 3}}
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+
+	// Stream 1 was evicted, and is treated as Closed.
+	t.recvMux <- &DataFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, STREAM_CLOSED)
+
+	// Re-created streams are again retired.
+	t.syncLoop(c)
+	c.Check(t.conn.streams, gc.HasLen, 0)
+	c.Check(t.conn.counts.closed, gc.HasLen, 0)
+}
+
+func (t *ConnectionTest) TestStreamCountsFollowTransitions(c *gc.C) {
+	t.addStream(1, Open)
+	t.addStream(3, Idle)
+	t.start()
+
+	t.syncLoop(c)
+	c.Check(t.conn.counts.active, gc.Equals, 1)
+
+	// Opening stream 5 implicitly closes idle stream 3.
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 5}}
+	t.syncLoop(c)
+	c.Check(t.conn.counts.active, gc.Equals, 2)
+	c.Check(t.streamState(3), gc.Equals, Closed)
+
+	for _, id := range []StreamID{1, 5} {
+		t.handle.queueMux <- &RstStreamFrame{
+			FramePrefix: FramePrefix{StreamID: id},
+			Error:       Error{Code: CANCEL},
+		}
+		t.expectSent(c)
+	}
+	t.syncLoop(c)
+	c.Check(t.conn.counts.active, gc.Equals, 0)
+	c.Check(t.conn.counts.closed, gc.HasLen, 0)
+	c.Check(t.conn.streams, gc.HasLen, 0)
+}
+
+func (t *ConnectionTest) TestStalledStreamResumesOnWindowUpdate(c *gc.C) {
+	events, _ := t.addStream(1, Open)
+	t.start()
+
+	t.handle.queueMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        []byte("hello world"),
+	}
+	t.handle.queueMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM}}
+
+	// Stream 1 is stalled, but doesn't block other frames.
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 1}, SizeDelta: 5}
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, 5)
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, -5)
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.DeepEquals, []byte("hello"))
+
+	// Remaining DATA, and the trailing HEADERS, are again stalled.
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 1}, SizeDelta: 100}
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, 100)
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, -6)
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.DeepEquals, []byte(" world"))
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &HeadersFrame{})
+}
+
+func (t *ConnectionTest) TestStalledConnectionResumesOnWindowUpdate(c *gc.C) {
+	events1, _ := t.addStream(1, Open)
+	events3, _ := t.addStream(3, Open)
+	t.conn.streams[1].SendFlowAvailable = 100
+	t.conn.streams[3].SendFlowAvailable = 100
+	t.conn.sendFlowAvailable = 0
+	t.start()
+
+	for _, id := range []StreamID{1, 3} {
+		t.handle.queueMux <- &DataFrame{
+			FramePrefix: FramePrefix{StreamID: id},
+			Data:        make([]byte, 10),
+		}
+	}
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+
+	// Both streams resume, until the connection window is exhausted.
+	t.recvMux <- &WindowUpdateFrame{SizeDelta: 15}
+	c.Check(t.expectSent(c).GetStreamID(), gc.Equals, StreamID(1))
+	c.Check(t.expectWindowDelta(c, events1), gc.Equals, -10)
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.HasLen, 5)
+	c.Check(t.expectWindowDelta(c, events3), gc.Equals, -5)
+
+	t.recvMux <- &WindowUpdateFrame{SizeDelta: 15}
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.HasLen, 5)
+	c.Check(t.expectWindowDelta(c, events3), gc.Equals, -5)
+}
+
+func (t *ConnectionTest) TestWindowUpdateOverflow(c *gc.C) {
+	t.addStream(1, Open)
+	t.conn.streams[1].SendFlowAvailable = kMaxWindowSize
+	t.conn.sendFlowAvailable = kMaxWindowSize
+	t.start()
+
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 1}, SizeDelta: 1}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, FLOW_CONTROL_ERROR)
+
+	t.recvMux <- &WindowUpdateFrame{SizeDelta: 1}
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, FLOW_CONTROL_ERROR)
+	t.expectClosed(c)
+}
+
+func (t *ConnectionTest) TestWindowUpdateOfIdleStream(c *gc.C) {
+	t.start()
+
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 3}, SizeDelta: 1}
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestRecieveInvalidSettings(c *gc.C) {
+	for _, tc := range []struct {
+		settings map[SettingID]uint32
+		code     ErrorCode
+	}{
+		{map[SettingID]uint32{SETTINGS_ENABLE_PUSH: 2}, PROTOCOL_ERROR},
+		{map[SettingID]uint32{
+			SETTINGS_INITIAL_WINDOW_SIZE: kMaxWindowSize + 1}, FLOW_CONTROL_ERROR},
+		{map[SettingID]uint32{
+			SETTINGS_INITIAL_WINDOW_SIZE: 100,
+			SETTINGS_ENABLE_PUSH:         2}, PROTOCOL_ERROR},
+	} {
+		t.setUp(true)
+		t.start()
+
+		t.recvMux <- &SettingsFrame{Settings: tc.settings}
+		goAway := t.expectSent(c).(*GoAwayFrame)
+		c.Check(goAway.Error.Code, gc.Equals, tc.code)
+		t.expectClosed(c)
+
+		// No setting of the frame was applied.
+		c.Check(t.conn.peerSettings, gc.Equals, kSettingDefaults)
+	}
+}
+
+func (t *ConnectionTest) TestRecieveUnknownSetting(c *gc.C) {
+	t.start()
+	t.recvMux <- &SettingsFrame{Settings: map[SettingID]uint32{0x10: 1}}
+	c.Check(t.expectSent(c).(*SettingsFrame).Flags, gc.Equals, ACK)
+}
+
+func (t *ConnectionTest) TestInitialWindowSizeAdjustsStreams(c *gc.C) {
+	events, _ := t.addStream(1, Open)
+	t.conn.streams[1].SendFlowAvailable = 65535
+	t.start()
+
+	t.recvMux <- &SettingsFrame{
+		Settings: map[SettingID]uint32{SETTINGS_INITIAL_WINDOW_SIZE: 0}}
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, -65535)
+	c.Check(t.expectSent(c).(*SettingsFrame).Flags, gc.Equals, ACK)
+
+	// DATA is stalled until the initial window is again raised.
+	t.handle.queueMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 10),
+	}
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+
+	t.recvMux <- &SettingsFrame{
+		Settings: map[SettingID]uint32{SETTINGS_INITIAL_WINDOW_SIZE: 10}}
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, 10)
+	c.Check(t.expectSent(c).(*SettingsFrame).Flags, gc.Equals, ACK)
+	c.Check(t.expectWindowDelta(c, events), gc.Equals, -10)
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.HasLen, 10)
+}
+
+var _ = gc.Suite(&ConnectionTest{})
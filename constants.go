@@ -224,9 +224,24 @@ func NewError(code ErrorCode, errArgs ...interface{}) *Error {
 }
 
 func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Code.String()
+	}
 	return e.Err.Error()
 }
 
+// Whether the error is of a stream which the peer did not process,
+// and which may therefore be safely retried (on a new connection, if
+// the peer sent GOAWAY).
+func (e *Error) Retryable() bool {
+	return e.Code == REFUSED_STREAM
+}
+
+// Returns the underlying error, for use with errors.Is and errors.As.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 func protocolError(errArgs ...interface{}) *Error {
 	return NewError(PROTOCOL_ERROR, errArgs...)
 }
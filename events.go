@@ -0,0 +1,108 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"fmt"
+)
+
+// Recieves events of a connection. OnEvent is called from the
+// connection's goroutine, and must not block.
+type EventHook interface {
+	OnEvent(event Event)
+}
+
+// Adapts a function to an EventHook.
+type EventHookFunc func(event Event)
+
+func (f EventHookFunc) OnEvent(event Event) {
+	f(event)
+}
+
+// One of StreamErrorEvent, ConnectionErrorEvent, GoAwaySentEvent,
+// GoAwayRecievedEvent, StallEvent, or StreamTransitionEvent.
+type Event interface {
+	fmt.Stringer
+	isEvent()
+}
+
+// An error of a single stream. If Err is a StreamError, the stream was
+// reset. If a RecoverableError, a frame of the stream was ignored or
+// dropped, and the connection and stream are otherwise unaffected.
+type StreamErrorEvent struct {
+	StreamID StreamID
+	Err      *Error
+}
+
+// A fatal error of the connection. GOAWAY is sent, and the connection
+// closes once it's written.
+type ConnectionErrorEvent struct {
+	Err *Error
+}
+
+// A GOAWAY was written.
+type GoAwaySentEvent struct {
+	GoAway *GoAwayFrame
+}
+
+// A GOAWAY was recieved from the peer.
+type GoAwayRecievedEvent struct {
+	GoAway *GoAwayFrame
+}
+
+// DATA of the stream, or of all streams if StreamID is 0, was stalled
+// on flow control. It resumes on WINDOW_UPDATE.
+type StallEvent struct {
+	StreamID StreamID
+}
+
+// The stream changed state. Reported only if Config.TraceStreams.
+type StreamTransitionEvent struct {
+	StreamID   StreamID
+	Transition StreamTransition
+}
+
+func (StreamErrorEvent) isEvent()      {}
+func (ConnectionErrorEvent) isEvent()  {}
+func (GoAwaySentEvent) isEvent()       {}
+func (GoAwayRecievedEvent) isEvent()   {}
+func (StallEvent) isEvent()            {}
+func (StreamTransitionEvent) isEvent() {}
+
+func (e StreamErrorEvent) String() string {
+	return fmt.Sprintf("stream %v %v (%v): %v",
+		e.StreamID, e.Err.Code, e.Err.Level, e.Err)
+}
+func (e ConnectionErrorEvent) String() string {
+	return fmt.Sprintf("connection %v: %v", e.Err.Code, e.Err)
+}
+func (e GoAwaySentEvent) String() string {
+	return fmt.Sprintf("sent GOAWAY %v, last stream %v",
+		e.GoAway.Error.Code, e.GoAway.LastID)
+}
+func (e GoAwayRecievedEvent) String() string {
+	return fmt.Sprintf("recieved GOAWAY %v, last stream %v",
+		e.GoAway.Error.Code, e.GoAway.LastID)
+}
+func (e StallEvent) String() string {
+	if e.StreamID == 0 {
+		return "connection stalled on flow control"
+	}
+	return fmt.Sprintf("stream %v stalled on flow control", e.StreamID)
+}
+func (e StreamTransitionEvent) String() string {
+	return fmt.Sprintf("stream %v %v", e.StreamID, e.Transition)
+}
+
+// Default EventHook, which logs errors, GOAWAYs, and traced stream
+// transitions through Config.Logf.
+type logEvents struct {
+	logf func(format string, args ...interface{})
+}
+
+func (l logEvents) OnEvent(event Event) {
+	if _, ok := event.(StallEvent); !ok {
+		l.logf("%v", event)
+	}
+}
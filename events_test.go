@@ -0,0 +1,66 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+func (t *ConnectionTest) TestEvents(c *gc.C) {
+	events := make(chan Event, 10)
+	t.conn.config.Events = EventHookFunc(func(event Event) {
+		events <- event
+	})
+	t.addStream(1, Open)
+	t.addStream(3, Open)
+	t.start()
+
+	t.handle.queueMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        []byte("stalled"),
+	}
+	t.recvMux <- &WindowUpdateFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.expectSent(c) // RST_STREAM.
+
+	goAway := &GoAwayFrame{LastID: 3}
+	t.recvMux <- goAway
+	t.recvMux <- &WindowUpdateFrame{}
+	t.expectSent(c) // GOAWAY.
+	t.expectClosed(c)
+
+	c.Check(<-events, gc.Equals, StallEvent{1})
+
+	streamErr := (<-events).(StreamErrorEvent)
+	c.Check(streamErr.StreamID, gc.Equals, StreamID(1))
+	c.Check(streamErr.Err.Code, gc.Equals, PROTOCOL_ERROR)
+	c.Check(streamErr.Err.Level, gc.Equals, StreamError)
+
+	c.Check(<-events, gc.Equals, GoAwayRecievedEvent{goAway})
+
+	connErr := (<-events).(ConnectionErrorEvent)
+	c.Check(connErr.Err.Code, gc.Equals, PROTOCOL_ERROR)
+
+	sent := (<-events).(GoAwaySentEvent)
+	c.Check(sent.GoAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+	c.Check(sent.String(), gc.Equals,
+		"sent GOAWAY PROTOCOL_ERROR, last stream 0")
+}
+
+func (t *ConnectionTest) TestRecoverableErrorEvent(c *gc.C) {
+	events := make(chan Event, 10)
+	t.conn.config.Events = EventHookFunc(func(event Event) {
+		events <- event
+	})
+	t.addStream(1, ClosedWithSentReset)
+	t.start()
+
+	// DATA following a sent RST_STREAM is ignored.
+	t.recvMux <- &DataFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.syncLoop(c)
+
+	event := (<-events).(StreamErrorEvent)
+	c.Check(event.StreamID, gc.Equals, StreamID(1))
+	c.Check(event.Err.Level, gc.Equals, RecoverableError)
+	c.Check(event.Err.Code, gc.Equals, STREAM_CLOSED)
+}
@@ -3,6 +3,9 @@
 // found in the LICENSE file.
 package http2
 
+// Maximum size of a flow-control window.
+const kMaxWindowSize = 0x7fffffff
+
 type RecieveFlow struct {
 	// Read bytes which have not been acknowledge by a sent WINDOW_UPDATE.
 	WinUsed int
@@ -14,7 +17,7 @@ type RecieveFlow struct {
 }
 
 func (f *RecieveFlow) ApplyDataRecieved(data *DataFrame) *Error {
-	f.WinUsed += len(data.Data) + int(data.PaddingLength)
+	f.WinUsed += data.PayloadLength()
 	if f.WinUsed > f.WinSize {
 		return flowControlError("DATA exceeded available window (%v vs %v)",
 			f.WinUsed, f.WinSize)
@@ -22,7 +25,34 @@ func (f *RecieveFlow) ApplyDataRecieved(data *DataFrame) *Error {
 	return nil
 }
 func (f *RecieveFlow) ApplyDataConsumed(data *DataFrame) {
-	f.WinUnacked += len(data.Data) + int(data.PaddingLength)
+	f.ApplyBytesConsumed(data.PayloadLength())
+}
+func (f *RecieveFlow) ApplyBytesConsumed(n int) {
+	f.WinUnacked += n
+}
+
+// Number of read bytes which aren't yet consumed.
+func (f *RecieveFlow) Unconsumed() int {
+	return f.WinUsed - f.WinUnacked
+}
+
+// Marks all read but unconsumed bytes as consumed (eg, because the
+// stream was reset). Returns the number of bytes released.
+func (f *RecieveFlow) ReleaseUnconsumed() int {
+	n := f.Unconsumed()
+	f.WinUnacked = f.WinUsed
+	return n
+}
+
+// Grows the window to size, if it's smaller. Returns the increase, to
+// be advertised through WINDOW_UPDATE.
+func (f *RecieveFlow) Grow(size int) int {
+	if size <= f.WinSize {
+		return 0
+	}
+	delta := size - f.WinSize
+	f.WinSize = size
+	return delta
 }
 func (f *RecieveFlow) OverUnackedThreshold() bool {
 	return f.WinUnacked*2 > f.WinSize
@@ -35,6 +65,7 @@ func (f *RecieveFlow) BuildWindowUpdate(id StreamID) *WindowUpdateFrame {
 		},
 		SizeDelta: uint32(f.WinUnacked),
 	}
+	f.WinUsed -= f.WinUnacked
 	f.WinUnacked = 0
 	return update
 }
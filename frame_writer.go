@@ -0,0 +1,354 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"io"
+	"net"
+	"sort"
+)
+
+// Largest frame payload permitted by the frame length field.
+const kMaxFramePayload = int(^kFrameLengthReservedMask)
+
+// Default number of buffered bytes at which output is flushed.
+const kDefaultFlushThreshold = 32 * 1024
+
+type HeaderEncoder interface {
+	// Encodes fields as a complete header block.
+	EncodeHeaderBlock(fields []HeaderField) ([]byte, *Error)
+}
+
+// Serializes frames to an underlying writer. Frames are buffered until
+// Flush(), which writes them together. DATA payloads of at least
+// VectoredThreshold bytes are referenced rather than copied, and are
+// written along with the surrounding frames as net.Buffers (with a single
+// writev, if the writer is a *net.TCPConn or similar).
+type FrameWriter struct {
+	// Threshold of buffered bytes at which WriteFrames() flushes, even if
+	// further frames are ready. Defaults to kDefaultFlushThreshold. If
+	// zero, each frame is flushed as it's written.
+	FlushThreshold int
+	// Minimum DATA payload written in place. Zero disables.
+	VectoredThreshold int
+
+	out     io.Writer
+	encoder HeaderEncoder
+
+	buf      []byte      // Serialized frames, not yet written.
+	vectored net.Buffers // Segments preceding buf, when writing vectored.
+	buffered int
+}
+
+func NewFrameWriter(out io.Writer, encoder HeaderEncoder) *FrameWriter {
+	return &FrameWriter{
+		FlushThreshold: kDefaultFlushThreshold,
+		out:            out,
+		encoder:        encoder,
+	}
+}
+
+// Number of bytes buffered but not yet written.
+func (w *FrameWriter) Buffered() int {
+	return w.buffered
+}
+
+// Writes frames recieved from sendMux until it's closed. Frames which
+// are ready together are coalesced: output is flushed once sendMux has
+// no further frame ready, or FlushThreshold bytes are buffered. A
+// buffered sendMux allows the connection to run ahead of the writer.
+func (w *FrameWriter) WriteFrames(sendMux <-chan Frame) *Error {
+	for frame := range sendMux {
+		if err := w.WriteFrame(frame); err != nil {
+			return err
+		}
+	drain:
+		for w.buffered < w.FlushThreshold {
+			select {
+			case next, ok := <-sendMux:
+				if !ok {
+					break drain
+				}
+				if err := w.WriteFrame(next); err != nil {
+					return err
+				}
+			default:
+				break drain
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes buffered frames to the underlying writer.
+func (w *FrameWriter) Flush() *Error {
+	if w.buffered == 0 {
+		return nil
+	}
+	var err error
+	if len(w.vectored) == 0 {
+		_, err = w.out.Write(w.buf)
+		w.buf = w.buf[:0]
+	} else {
+		// buf may still be referenced by w.vectored. Don't reuse it.
+		buffers := append(w.vectored, w.buf)
+		_, err = buffers.WriteTo(w.out)
+		w.vectored, w.buf = nil, nil
+	}
+	w.buffered = 0
+
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// Serializes the frame to the buffer. HEADERS and PUSH_PROMISE whose
+// header block exceeds the frame payload are followed by CONTINUATION.
+func (w *FrameWriter) WriteFrame(frame Frame) *Error {
+	switch f := frame.(type) {
+	case *DataFrame:
+		return w.writeDataFrame(f)
+	case *HeadersFrame:
+		return w.writeHeadersFrame(f)
+	case *PriorityFrame:
+		if err := checkPriorityFlags(f.Flags); err != nil {
+			return err
+		}
+		w.writePrefix(PRIORITY, f.Flags, f.StreamID, priorityLength(f.Flags))
+		w.writePriority(f.Flags, f.FramePriority)
+	case *RstStreamFrame:
+		w.writePrefix(RST_STREAM, f.Flags, f.StreamID, 4)
+		w.writeUint32(uint32(f.Error.Code))
+	case *SettingsFrame:
+		return w.writeSettingsFrame(f)
+	case *PushPromiseFrame:
+		return w.writePushPromiseFrame(f)
+	case *PingFrame:
+		w.writePrefix(PING, f.Flags, f.StreamID, 8)
+		w.writeUint32(uint32(f.OpaqueData >> 32))
+		w.writeUint32(uint32(f.OpaqueData))
+	case *GoAwayFrame:
+		var debug []byte
+		if f.Error.Err != nil {
+			debug = []byte(f.Error.Err.Error())
+		}
+		if 8+len(debug) > kMaxFramePayload {
+			debug = debug[:kMaxFramePayload-8]
+		}
+		w.writePrefix(GOAWAY, f.Flags, f.StreamID, 8+len(debug))
+		w.writeUint32(uint32(f.LastID))
+		w.writeUint32(uint32(f.Error.Code))
+		w.writeBytes(debug)
+	case *WindowUpdateFrame:
+		w.writePrefix(WINDOW_UPDATE, f.Flags, f.StreamID, 4)
+		w.writeUint32(f.SizeDelta)
+	default:
+		return internalError("cannot write frame %#v", frame)
+	}
+	return nil
+}
+
+func (w *FrameWriter) writeDataFrame(f *DataFrame) *Error {
+	flags, padBytes := paddingFlags(f.Flags, f.PaddingLength)
+	length := padBytes + len(f.Data) + int(f.PaddingLength)
+	if length > kMaxFramePayload {
+		return internalError("DATA payload of %v exceeds maximum", length)
+	}
+	w.writePrefix(DATA, flags, f.StreamID, length)
+	w.writePaddingLength(f.PaddingLength)
+
+	if w.VectoredThreshold != 0 && len(f.Data) >= w.VectoredThreshold {
+		// Reference the payload, and begin a new buffer after it.
+		w.vectored = append(w.vectored, w.buf, f.Data)
+		w.buf = nil
+		w.buffered += len(f.Data)
+	} else {
+		w.writeBytes(f.Data)
+	}
+	w.writeBytes(make([]byte, f.PaddingLength))
+	return nil
+}
+
+func (w *FrameWriter) writeHeadersFrame(f *HeadersFrame) *Error {
+	// Checked before encoding, which updates the encoder's state.
+	if err := checkPriorityFlags(f.Flags); err != nil {
+		return err
+	}
+	block, err := w.encoder.EncodeHeaderBlock(f.Fields)
+	if err != nil {
+		return err
+	}
+	padding := headerPadding(HEADERS, f.padding, f.PaddingLength, len(block))
+	flags, padBytes := paddingFlags(f.Flags, padding)
+	fixed := padBytes + priorityLength(flags) + int(padding)
+
+	fragment, block := splitBlock(block, kMaxFramePayload-fixed)
+	if len(block) == 0 {
+		flags |= END_HEADERS
+	} else {
+		flags &^= END_HEADERS
+	}
+	w.writePrefix(HEADERS, flags, f.StreamID, fixed+len(fragment))
+	w.writePaddingLength(padding)
+	w.writePriority(flags, f.FramePriority)
+	w.writeBytes(fragment)
+	w.writeBytes(make([]byte, padding))
+
+	w.writeContinuations(f.StreamID, block)
+	return nil
+}
+
+func (w *FrameWriter) writePushPromiseFrame(f *PushPromiseFrame) *Error {
+	block, err := w.encoder.EncodeHeaderBlock(f.Fields)
+	if err != nil {
+		return err
+	}
+	padding := headerPadding(PUSH_PROMISE, f.padding, f.PaddingLength,
+		len(block))
+	flags, padBytes := paddingFlags(f.Flags, padding)
+	fixed := padBytes + 4 + int(padding)
+
+	fragment, block := splitBlock(block, kMaxFramePayload-fixed)
+	if len(block) == 0 {
+		flags |= END_HEADERS
+	} else {
+		flags &^= END_HEADERS
+	}
+	w.writePrefix(PUSH_PROMISE, flags, f.StreamID, fixed+len(fragment))
+	w.writePaddingLength(padding)
+	w.writeUint32(uint32(f.PromisedID))
+	w.writeBytes(fragment)
+	w.writeBytes(make([]byte, padding))
+
+	w.writeContinuations(f.StreamID, block)
+	return nil
+}
+
+// Returns the padding of a header block of length encoded bytes, chosen
+// by the frame's policy (if any). Padding set by the frame's owner is
+// left as-is.
+func headerPadding(frameType FrameType, policy PaddingPolicy,
+	padding uint16, length int) uint16 {
+
+	if padding != 0 || policy == nil {
+		return padding
+	}
+	max := boundPadding(kMaxFramePayload-kMaxPaddedOverhead-length,
+		kMaxFramePayload)
+	return uint16(boundPadding(policy.Padding(frameType, length, max), max))
+}
+
+// Writes the remainder of a header block as CONTINUATION frames.
+func (w *FrameWriter) writeContinuations(id StreamID, block []byte) {
+	for len(block) != 0 {
+		var fragment []byte
+		fragment, block = splitBlock(block, kMaxFramePayload)
+
+		flags := NO_FLAGS
+		if len(block) == 0 {
+			flags = END_HEADERS
+		}
+		w.writePrefix(CONTINUATION, flags, id, len(fragment))
+		w.writeBytes(fragment)
+	}
+}
+
+func (w *FrameWriter) writeSettingsFrame(f *SettingsFrame) *Error {
+	// Settings are written in ID order.
+	ids := make([]int, 0, len(f.Settings))
+	for id := range f.Settings {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	w.writePrefix(SETTINGS, f.Flags, f.StreamID, 5*len(ids))
+	for _, id := range ids {
+		w.writeBytes([]byte{byte(id)})
+		w.writeUint32(f.Settings[SettingID(id)])
+	}
+	return nil
+}
+
+func (w *FrameWriter) writePrefix(frameType FrameType, flags Flags,
+	id StreamID, length int) {
+	w.buf = append(w.buf, byte(length>>8), byte(length),
+		byte(frameType), byte(flags))
+	w.buffered += 4
+	w.writeUint32(uint32(id))
+}
+
+func (w *FrameWriter) writePaddingLength(length uint16) {
+	if length > 0xff {
+		w.writeBytes([]byte{byte(length >> 8)})
+	}
+	if length != 0 {
+		w.writeBytes([]byte{byte(length)})
+	}
+}
+
+func (w *FrameWriter) writePriority(flags Flags, priority FramePriority) {
+	if flags&PRIORITY_GROUP != 0 {
+		w.writeUint32(priority.PriorityGroup)
+		w.writeBytes([]byte{priority.PriorityWeight})
+	}
+	if flags&PRIORITY_DEPENDENCY != 0 {
+		dependency := priority.StreamDependency
+		if priority.ExclusiveDependency {
+			dependency |= kStreamIDReservedMask
+		}
+		w.writeUint32(uint32(dependency))
+	}
+}
+
+func (w *FrameWriter) writeUint32(value uint32) {
+	w.buf = append(w.buf, byte(value>>24), byte(value>>16),
+		byte(value>>8), byte(value))
+	w.buffered += 4
+}
+
+func (w *FrameWriter) writeBytes(b []byte) {
+	w.buf = append(w.buf, b...)
+	w.buffered += len(b)
+}
+
+// Sets PAD_LOW and PAD_HIGH as required by the padding length, and
+// returns the number of bytes used to encode it.
+func paddingFlags(flags Flags, length uint16) (Flags, int) {
+	flags &^= PAD_LOW | PAD_HIGH
+	if length > 0xff {
+		return flags | PAD_LOW | PAD_HIGH, 2
+	} else if length != 0 {
+		return flags | PAD_LOW, 1
+	}
+	return flags, 0
+}
+
+// A frame may carry a priority group or a dependency, but not both.
+func checkPriorityFlags(flags Flags) *Error {
+	if flags&PRIORITY_GROUP != 0 && flags&PRIORITY_DEPENDENCY != 0 {
+		return internalError(
+			"both PRIORITY_GROUP and PRIORITY_DEPENDENCY set")
+	}
+	return nil
+}
+
+func priorityLength(flags Flags) int {
+	if flags&PRIORITY_GROUP != 0 {
+		return 5
+	} else if flags&PRIORITY_DEPENDENCY != 0 {
+		return 4
+	}
+	return 0
+}
+
+func splitBlock(block []byte, bound int) ([]byte, []byte) {
+	if len(block) <= bound {
+		return block, nil
+	}
+	return block[:bound], block[bound:]
+}
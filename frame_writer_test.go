@@ -0,0 +1,254 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+type FrameWriterTest struct {
+	output *bytes.Buffer
+	writer *FrameWriter
+}
+
+func (t *FrameWriterTest) SetUpTest(c *gc.C) {
+	t.output = new(bytes.Buffer)
+	t.writer = NewFrameWriter(t.output, t)
+}
+
+// HeaderEncoder implementation. Encodes the concatenated values of
+// fields, which are recovered by ParserTest's HeaderDecoder.
+func (t *FrameWriterTest) EncodeHeaderBlock(
+	fields []HeaderField) ([]byte, *Error) {
+	var block []byte
+	for _, field := range fields {
+		block = append(block, field.Values...)
+	}
+	return block, nil
+}
+
+func (t *FrameWriterTest) write(c *gc.C, frames ...Frame) {
+	for _, frame := range frames {
+		c.Assert(t.writer.WriteFrame(frame), gc.IsNil)
+	}
+	c.Assert(t.writer.Flush(), gc.IsNil)
+}
+
+func (t *FrameWriterTest) parse(c *gc.C) Frame {
+	frame, err := NewFrameParser(t.output, &ParserTest{}).ParseFrame()
+	c.Assert(err, gc.IsNil)
+	return frame
+}
+
+func (t *FrameWriterTest) TestWriteDataFrame(c *gc.C) {
+	t.write(c, &DataFrame{
+		FramePrefix:  FramePrefix{StreamID: 1, Flags: END_STREAM},
+		FramePadding: FramePadding{2},
+		Data:         []byte("abc"),
+	})
+	c.Check(t.output.Bytes(), gc.DeepEquals, []byte{
+		0x00, 0x06, byte(DATA), byte(END_STREAM | PAD_LOW),
+		0x00, 0x00, 0x00, 0x01,
+		0x02, 'a', 'b', 'c', 0x00, 0x00,
+	})
+}
+
+func (t *FrameWriterTest) TestRoundTrip(c *gc.C) {
+	for _, frame := range []Frame{
+		&DataFrame{
+			FramePrefix:  FramePrefix{StreamID: 1, Flags: PAD_LOW | PAD_HIGH},
+			FramePadding: FramePadding{300},
+			Data:         []byte("padded"),
+		},
+		&PriorityFrame{
+			FramePrefix:   FramePrefix{StreamID: 3, Flags: PRIORITY_DEPENDENCY},
+			FramePriority: FramePriority{ExclusiveDependency: true, StreamDependency: 1},
+		},
+		&RstStreamFrame{
+			FramePrefix: FramePrefix{StreamID: 5},
+			Error:       Error{Code: CANCEL, Level: StreamError},
+		},
+		&SettingsFrame{Settings: map[SettingID]uint32{
+			SETTINGS_ENABLE_PUSH: 0, SETTINGS_INITIAL_WINDOW_SIZE: 1 << 20}},
+		&PingFrame{FramePrefix: FramePrefix{Flags: ACK}, OpaqueData: 1<<40 + 7},
+		&GoAwayFrame{LastID: 7, Error: Error{Code: PROTOCOL_ERROR,
+			Level: ConnectionError, Err: errors.New("debug")}},
+		&WindowUpdateFrame{FramePrefix: FramePrefix{StreamID: 9}, SizeDelta: 1024},
+	} {
+		t.write(c, frame)
+		c.Check(t.parse(c), gc.DeepEquals, frame)
+	}
+}
+
+func (t *FrameWriterTest) TestWriteHeadersFrame(c *gc.C) {
+	t.write(c, &HeadersFrame{
+		FramePrefix:   FramePrefix{StreamID: 1, Flags: PRIORITY_GROUP},
+		FramePriority: FramePriority{PriorityGroup: 3, PriorityWeight: 16},
+		Fields:        []HeaderField{{Name: "fragment", Values: "block"}},
+	})
+	headers := t.parse(c).(*HeadersFrame)
+	c.Check(headers.Flags, gc.Equals, PRIORITY_GROUP|END_HEADERS)
+	c.Check(headers.PriorityGroup, gc.Equals, uint32(3))
+	c.Check(headers.PriorityWeight, gc.Equals, uint8(16))
+	c.Check(headers.Fields[0].Values, gc.Equals, "block")
+}
+
+func (t *FrameWriterTest) TestPriorityGroupExcludesDependency(c *gc.C) {
+	flags := PRIORITY_GROUP | PRIORITY_DEPENDENCY
+	c.Check(t.writer.WriteFrame(&HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: flags},
+	}), gc.ErrorMatches, "both PRIORITY_GROUP and PRIORITY_DEPENDENCY set")
+	c.Check(t.writer.WriteFrame(&PriorityFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: flags},
+	}), gc.ErrorMatches, "both PRIORITY_GROUP and PRIORITY_DEPENDENCY set")
+
+	// Nothing was written.
+	c.Assert(t.writer.Flush(), gc.IsNil)
+	c.Check(t.output.Len(), gc.Equals, 0)
+}
+
+func (t *FrameWriterTest) TestLargeHeaderBlockIsContinued(c *gc.C) {
+	block := strings.Repeat("x", kMaxFramePayload+10)
+	t.write(c, &PushPromiseFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		PromisedID:  2,
+		Fields:      []HeaderField{{Name: "fragment", Values: block}},
+	})
+	parser := NewFrameParser(t.output, &ParserTest{})
+
+	frame, err := parser.ParseFrame()
+	c.Assert(err, gc.IsNil)
+	promise := frame.(*PushPromiseFrame)
+	c.Check(promise.Flags&END_HEADERS, gc.Equals, NO_FLAGS)
+	c.Check(promise.Fields[0].Values, gc.HasLen, kMaxFramePayload-4)
+
+	frame, err = parser.ParseFrame()
+	c.Assert(err, gc.IsNil)
+	continuation := frame.(*ContinuationFrame)
+	c.Check(continuation.Flags, gc.Equals, END_HEADERS)
+	c.Check(continuation.Fields[0].Values, gc.HasLen, 14)
+}
+
+func (t *FrameWriterTest) TestVectoredWriteMatchesCopied(c *gc.C) {
+	frames := []Frame{
+		&DataFrame{FramePrefix: FramePrefix{StreamID: 1}, Data: []byte("large")},
+		&PingFrame{},
+		&DataFrame{FramePrefix: FramePrefix{StreamID: 3}, Data: []byte("s")},
+	}
+	t.write(c, frames...)
+	copied := append([]byte(nil), t.output.Bytes()...)
+
+	t.output.Reset()
+	t.writer.VectoredThreshold = 4
+	t.write(c, frames...)
+	c.Check(t.output.Bytes(), gc.DeepEquals, copied)
+}
+
+// Counts writes to the underlying writer.
+type countingWriter struct {
+	io.Writer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Writer.Write(p)
+}
+
+func (t *FrameWriterTest) TestWriteFramesCoalesces(c *gc.C) {
+	for _, threshold := range []int{kDefaultFlushThreshold, 0} {
+		out := &countingWriter{Writer: new(bytes.Buffer)}
+		writer := NewFrameWriter(out, t)
+		writer.FlushThreshold = threshold
+
+		sendMux := make(chan Frame, 5)
+		for i := 0; i != 5; i++ {
+			sendMux <- &PingFrame{OpaqueData: uint64(i)}
+		}
+		close(sendMux)
+		c.Check(writer.WriteFrames(sendMux), gc.IsNil)
+
+		if threshold == 0 {
+			c.Check(out.writes, gc.Equals, 5)
+		} else {
+			c.Check(out.writes, gc.Equals, 1)
+		}
+	}
+}
+
+var _ = gc.Suite(&FrameWriterTest{})
+
+// Writes bursts of DATA over a loopback TCP connection, and reports
+// writes per burst (where they can be counted).
+func benchmarkWriteFrames(b *testing.B, flushThreshold, vectoredThreshold int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Counting writes defeats vectored writes, which require the conn.
+	var out io.Writer = conn
+	counter := &countingWriter{Writer: conn}
+	if vectoredThreshold == 0 {
+		out = counter
+	}
+	writer := NewFrameWriter(out, nil)
+	writer.FlushThreshold = flushThreshold
+	writer.VectoredThreshold = vectoredThreshold
+
+	const burst = 16
+	payload := make([]byte, 1024)
+	sendMux := make(chan Frame, burst)
+	done := make(chan *Error)
+	go func() { done <- writer.WriteFrames(sendMux) }()
+
+	b.SetBytes(burst * int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j != burst; j++ {
+			sendMux <- &DataFrame{
+				FramePrefix: FramePrefix{StreamID: 1},
+				Data:        payload,
+			}
+		}
+	}
+	close(sendMux)
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+	if vectoredThreshold == 0 {
+		b.ReportMetric(float64(counter.writes)/float64(b.N), "writes/op")
+	}
+}
+
+func BenchmarkWriteFramesUnbuffered(b *testing.B) {
+	benchmarkWriteFrames(b, 0, 0)
+}
+func BenchmarkWriteFramesCoalesced(b *testing.B) {
+	benchmarkWriteFrames(b, kDefaultFlushThreshold, 0)
+}
+func BenchmarkWriteFramesVectored(b *testing.B) {
+	benchmarkWriteFrames(b, kDefaultFlushThreshold, 512)
+}
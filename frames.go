@@ -59,6 +59,10 @@ type HeadersFrame struct {
 	FramePriority
 
 	Fields []HeaderField
+
+	// Chooses padding from the encoded length of the header block, if
+	// PaddingLength is zero. Set from Config.Padding as the frame is sent.
+	padding PaddingPolicy
 }
 
 type PriorityFrame struct {
@@ -84,6 +88,9 @@ type PushPromiseFrame struct {
 
 	PromisedID StreamID
 	Fields     []HeaderField
+
+	// Chooses padding, as HeadersFrame.padding.
+	padding PaddingPolicy
 }
 
 type PingFrame struct {
@@ -177,11 +184,54 @@ func (f *ContinuationFrame) GetType() FrameType {
 	return CONTINUATION
 }
 
+// Length of the frame's payload, all of which counts against flow
+// control: its data and padding, and the fields encoding the padding
+// length. Those fields are as flagged by PAD_LOW and PAD_HIGH (as
+// recieved), or if neither is set, as PaddingLength requires.
 func (f *DataFrame) PayloadLength() int {
-	return len(f.Data) + int(f.PaddingLength)
+	padBytes := 0
+	if f.Flags&PAD_HIGH != 0 {
+		padBytes = 2
+	} else if f.Flags&PAD_LOW != 0 {
+		padBytes = 1
+	} else {
+		_, padBytes = paddingFlags(f.Flags, f.PaddingLength)
+	}
+	return padBytes + len(f.Data) + int(f.PaddingLength)
 }
+
+// Largest padding which, along with the fields encoding its length,
+// fits within n bytes of payload.
+func maxPaddingWithin(n int) int {
+	if n > 0xff+1 {
+		return n - 2
+	} else if n > 0 {
+		return n - 1
+	}
+	return 0
+}
+
+// Truncates the frame payload to at most bound bytes, returning a frame
+// with the remainder. Data is preferred over padding in the truncated
+// frame, and END_STREAM and END_SEGMENT move to the remainder. PAD_LOW
+// and PAD_HIGH of each frame are set as its padding requires.
 func (f *DataFrame) SplitAt(bound int) *DataFrame {
-	// TODO(johng)
-	panic(bound)
-	return nil
+	remainder := &DataFrame{FramePrefix: f.FramePrefix}
+
+	if bound < len(f.Data) {
+		remainder.Data = f.Data[bound:]
+		remainder.PaddingLength = f.PaddingLength
+		f.Data = f.Data[:bound]
+		f.PaddingLength = 0
+	} else {
+		padding := uint16(maxPaddingWithin(bound - len(f.Data)))
+		remainder.Data = f.Data[len(f.Data):]
+		remainder.PaddingLength = f.PaddingLength - padding
+		f.PaddingLength = padding
+	}
+	f.Flags &^= END_STREAM | END_SEGMENT
+	f.Flags, _ = paddingFlags(f.Flags, f.PaddingLength)
+	remainder.Flags, _ = paddingFlags(remainder.Flags,
+		remainder.PaddingLength)
+	return remainder
 }
@@ -0,0 +1,50 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+type FramesTest struct{}
+
+func (t *FramesTest) TestDataSplitAt(c *gc.C) {
+	frame := &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1,
+			Flags: END_STREAM | END_SEGMENT | PAD_LOW},
+		FramePadding: FramePadding{4},
+		Data:         []byte("hello world"),
+	}
+	remainder := frame.SplitAt(5)
+
+	c.Check(frame.Data, gc.DeepEquals, []byte("hello"))
+	c.Check(frame.PaddingLength, gc.Equals, uint16(0))
+	c.Check(frame.Flags, gc.Equals, NO_FLAGS)
+
+	c.Check(remainder.StreamID, gc.Equals, StreamID(1))
+	c.Check(remainder.Data, gc.DeepEquals, []byte(" world"))
+	c.Check(remainder.PaddingLength, gc.Equals, uint16(4))
+	c.Check(remainder.Flags, gc.Equals, END_STREAM|END_SEGMENT|PAD_LOW)
+}
+
+func (t *FramesTest) TestDataSplitWithinPadding(c *gc.C) {
+	frame := &DataFrame{
+		FramePrefix:  FramePrefix{StreamID: 1, Flags: END_STREAM | PAD_LOW},
+		FramePadding: FramePadding{4},
+		Data:         []byte("hello"),
+	}
+	remainder := frame.SplitAt(7)
+
+	// The padding length field is within the bound.
+	c.Check(frame.Data, gc.DeepEquals, []byte("hello"))
+	c.Check(frame.PaddingLength, gc.Equals, uint16(1))
+	c.Check(frame.Flags, gc.Equals, PAD_LOW)
+	c.Check(frame.PayloadLength(), gc.Equals, 7)
+
+	c.Check(remainder.Data, gc.HasLen, 0)
+	c.Check(remainder.PaddingLength, gc.Equals, uint16(3))
+	c.Check(remainder.Flags, gc.Equals, END_STREAM|PAD_LOW)
+}
+
+var _ = gc.Suite(&FramesTest{})
@@ -0,0 +1,79 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	StatusContinue           = 100
+	StatusSwitchingProtocols = 101
+	StatusEarlyHints         = 103
+)
+
+// Bound of interim responses recieved on a stream. Each is delivered
+// to the stream's owner as an event, so a peer sending many could grow
+// the stream's pending events without bound.
+const kMaxInformationalResponses = 16
+
+// Returns the :status of a response header block, or zero if it has none.
+func responseStatus(fields []HeaderField) int {
+	for _, field := range fields {
+		if field.Name == ":status" {
+			status, err := strconv.Atoi(field.Values)
+			if err != nil {
+				return 0
+			}
+			return status
+		}
+	}
+	return 0
+}
+
+// Whether the header block is an interim (1xx) response. Several
+// interim responses may precede a stream's final response.
+func isInformational(fields []HeaderField) bool {
+	status := responseStatus(fields)
+	return status >= 100 && status < 200
+}
+
+// Interim responses may not end the stream. HTTP/2 has no 101
+// (Switching Protocols).
+func validateInformational(id StreamID, fields []HeaderField, fin bool) *Error {
+	if status := responseStatus(fields); status == StatusSwitchingProtocols {
+		return protocolError("status %v on stream %v", status, id)
+	} else if fin {
+		return protocolError("interim response %v of stream %v with END_STREAM",
+			status, id)
+	}
+	return nil
+}
+
+// Queues an interim response of the stream, such as 103 (Early Hints),
+// to precede its final response. The status must be 1xx, and fields
+// may not include :status. Fails once the final response is queued by
+// WriteHeaders(), as interim responses may not follow it.
+func (h *StreamHandle) WriteInformational(status int,
+	fields []HeaderField) error {
+
+	if status < 100 || status >= 200 || status == StatusSwitchingProtocols {
+		return &Error{Code: INTERNAL_ERROR, Level: RecoverableError,
+			Err: fmt.Errorf("invalid interim status %v", status)}
+	} else if h.send.sentHeaders() {
+		return &Error{Code: INTERNAL_ERROR, Level: RecoverableError,
+			Err: fmt.Errorf("interim response of stream %v "+
+				"follows its final response", h.ID)}
+	}
+	headers := &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: h.ID},
+		Fields: append([]HeaderField{
+			{Name: ":status", Values: strconv.Itoa(status)}}, fields...),
+	}
+	if err := h.conn.queue(headers); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+func (t *ConnectionTest) TestRecieveInformational(c *gc.C) {
+	t.setUp(false)
+	var interim [][]HeaderField
+	t.conn.config.OnInformational = func(id StreamID, fields []HeaderField) {
+		c.Check(id, gc.Equals, StreamID(1))
+		interim = append(interim, fields)
+	}
+	handle := t.addOwnedStream(1, HalfClosedLocal, 100)
+	t.start()
+
+	continue100 := []HeaderField{{Name: ":status", Values: "100"}}
+	earlyHints := []HeaderField{
+		{Name: ":status", Values: "103"},
+		{Name: "link", Values: "</style.css>; rel=preload"},
+	}
+	final := []HeaderField{{Name: ":status", Values: "200"}}
+	trailers := []HeaderField{{Name: "grpc-status", Values: "0"}}
+
+	for _, fields := range [][]HeaderField{continue100, earlyHints, final} {
+		t.recvMux <- &HeadersFrame{
+			FramePrefix: FramePrefix{StreamID: 1},
+			Fields:      fields,
+		}
+	}
+	// Interim responses don't count as the final response, and the next
+	// HEADERS are trailers.
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Fields:      trailers,
+	}
+	t.syncLoop(c)
+	c.Check(interim, gc.DeepEquals, [][]HeaderField{continue100, earlyHints})
+	c.Check(t.streamState(1), gc.Equals, Closed)
+
+	events := []StreamEvent{
+		&HeadersEvent{Fields: continue100, Informational: true},
+		&HeadersEvent{Fields: earlyHints, Informational: true},
+		&HeadersEvent{Fields: final},
+		&HeadersEvent{Fields: trailers, Trailers: true},
+		&ClosedEvent{},
+	}
+	for _, expected := range events {
+		c.Check(t.expectEvent(c, handle.events), gc.DeepEquals, expected)
+	}
+}
+
+func (t *ConnectionTest) TestInformationalMayNotEndStream(c *gc.C) {
+	t.setUp(false)
+	t.addStream(1, HalfClosedLocal)
+	t.addStream(3, HalfClosedLocal)
+	t.start()
+
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Fields:      []HeaderField{{Name: ":status", Values: "103"}},
+	}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, PROTOCOL_ERROR)
+
+	// Nor is 101 (Switching Protocols) permitted.
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 3},
+		Fields:      []HeaderField{{Name: ":status", Values: "101"}},
+	}
+	rst = t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(3))
+	c.Check(rst.Error.Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestInformationalResponsesAreBounded(c *gc.C) {
+	t.setUp(false)
+	events, _ := t.addStream(1, HalfClosedLocal)
+	t.start()
+
+	for i := 0; i != kMaxInformationalResponses+1; i++ {
+		t.recvMux <- &HeadersFrame{
+			FramePrefix: FramePrefix{StreamID: 1},
+			Fields:      []HeaderField{{Name: ":status", Values: "103"}},
+		}
+	}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, PROTOCOL_ERROR)
+
+	for i := 0; i != kMaxInformationalResponses; i++ {
+		c.Check(t.expectEvent(c, events).(*HeadersEvent).Informational,
+			gc.Equals, true)
+	}
+	c.Check(t.expectEvent(c, events), gc.FitsTypeOf, &ResetEvent{})
+}
+
+func (t *ConnectionTest) TestWriteEarlyHints(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	handle.send.headersSent = false
+	t.start()
+
+	link := []HeaderField{{Name: "link", Values: "</style.css>; rel=preload"}}
+	c.Check(handle.WriteInformational(StatusEarlyHints, link), gc.IsNil)
+	c.Check(handle.WriteInformational(StatusEarlyHints, link), gc.IsNil)
+	c.Check(handle.WriteInformational(200, nil), gc.ErrorMatches,
+		"invalid interim status 200")
+
+	for i := 0; i != 2; i++ {
+		sent := t.expectSent(c).(*HeadersFrame)
+		c.Check(sent.Flags, gc.Equals, Flags(0))
+		c.Check(sent.Fields, gc.DeepEquals, append([]HeaderField{
+			{Name: ":status", Values: "103"}}, link...))
+	}
+
+	// Once the final response is queued, interim responses fail.
+	c.Check(handle.WriteHeaders(
+		[]HeaderField{{Name: ":status", Values: "200"}}, false), gc.IsNil)
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &HeadersFrame{})
+	c.Check(handle.WriteInformational(StatusContinue, nil), gc.ErrorMatches,
+		"interim response of stream 1 follows its final response")
+
+	// Interim responses which raced with the final response are dropped.
+	handle.send.headersSent = false
+	c.Check(handle.WriteInformational(StatusContinue, nil), gc.IsNil)
+	t.handle.queueMux <- &PingFrame{}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.streamState(1), gc.Equals, Open)
+}
+
+func (t *ConnectionTest) TestServerRespondsToPeerOpenedStream(c *gc.C) {
+	handles := make(chan *StreamHandle, 1)
+	t.conn.config.OnStream = func(stream *StreamHandle) {
+		handles <- stream
+	}
+	t.start()
+
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Fields:      []HeaderField{{Name: ":path", Values: "/"}},
+	}
+	handle := <-handles
+	c.Check(handle.ID, gc.Equals, StreamID(1))
+	c.Check(t.expectEvent(c, handle.events), gc.FitsTypeOf, &WindowEvent{})
+	c.Check(t.expectEvent(c, handle.events), gc.FitsTypeOf, &HeadersEvent{})
+
+	c.Check(handle.WriteInformational(StatusEarlyHints, nil), gc.IsNil)
+	c.Check(handle.WriteHeaders(
+		[]HeaderField{{Name: ":status", Values: "103"}}, false),
+		gc.ErrorMatches, "interim response of stream 1 isn't final")
+	c.Check(handle.WriteHeaders(
+		[]HeaderField{{Name: ":status", Values: "200"}}, false), gc.IsNil)
+	c.Check(handle.WriteHeaders(
+		[]HeaderField{{Name: ":status", Values: "200"}}, true),
+		gc.ErrorMatches, "headers of stream 1 were already sent")
+	_, err := handle.Write([]byte("body"))
+	c.Check(err, gc.IsNil)
+	c.Check(handle.Close(), gc.IsNil)
+
+	c.Check(responseStatus(t.expectSent(c).(*HeadersFrame).Fields),
+		gc.Equals, StatusEarlyHints)
+	c.Check(responseStatus(t.expectSent(c).(*HeadersFrame).Fields),
+		gc.Equals, 200)
+	c.Check(string(t.expectSent(c).(*DataFrame).Data), gc.Equals, "body")
+	c.Check(t.expectSent(c).(*DataFrame).Flags, gc.Equals, END_STREAM)
+	t.syncLoop(c)
+	c.Check(t.streamState(1), gc.Equals, Closed)
+}
+
+func (t *ConnectionTest) TestWritesBeforeResponseFail(c *gc.C) {
+	var handle *StreamHandle
+	t.conn.config.OnStream = func(stream *StreamHandle) { handle = stream }
+	t.start()
+
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.syncLoop(c)
+	c.Assert(handle, gc.NotNil)
+
+	const notSent = "response headers of stream 1 weren't sent"
+	_, err := handle.Write([]byte("body"))
+	c.Check(err, gc.ErrorMatches, notSent)
+	_, err = handle.WriteSegment([]byte("body"))
+	c.Check(err, gc.ErrorMatches, notSent)
+	c.Check(handle.CloseWrite(), gc.ErrorMatches, notSent)
+	c.Check(handle.WriteTrailers(nil), gc.ErrorMatches, notSent)
+
+	// Nothing was queued, and the stream may still respond.
+	t.syncLoop(c)
+	c.Check(handle.WriteHeaders(
+		[]HeaderField{{Name: ":status", Values: "200"}}, false), gc.IsNil)
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &HeadersFrame{})
+	c.Check(handle.CloseWrite(), gc.IsNil)
+	c.Check(t.expectSent(c).(*DataFrame).Flags, gc.Equals, END_STREAM)
+}
+
+func (t *ConnectionTest) TestResponseEndingStream(c *gc.C) {
+	var handle *StreamHandle
+	t.conn.config.OnStream = func(stream *StreamHandle) { handle = stream }
+	t.start()
+
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM}}
+	t.syncLoop(c)
+	c.Assert(handle, gc.NotNil)
+
+	c.Check(handle.WriteHeaders(
+		[]HeaderField{{Name: ":status", Values: "204"}}, true), gc.IsNil)
+	c.Check(t.expectSent(c).(*HeadersFrame).Flags, gc.Equals, END_STREAM)
+	_, err := handle.Write([]byte("body"))
+	c.Check(err.(*Error).Code, gc.Equals, STREAM_CLOSED)
+}
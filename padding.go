@@ -0,0 +1,96 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"math/rand"
+)
+
+// Largest overhead of a padded frame, other than its content and padding:
+// the padding length fields, and the priority fields of HEADERS.
+const kMaxPaddedOverhead = 2 + 5
+
+// Chooses the padding of sent DATA, HEADERS, and PUSH_PROMISE frames,
+// which obscures the lengths of their content from traffic analysis.
+type PaddingPolicy interface {
+	// Returns the padding of a frame of the type having length bytes of
+	// content. Padding is bounded by max, which may be zero.
+	Padding(frameType FrameType, length, max int) int
+}
+
+// Adapts a function to a PaddingPolicy.
+type PaddingFunc func(frameType FrameType, length, max int) int
+
+func (f PaddingFunc) Padding(frameType FrameType, length, max int) int {
+	return f(frameType, length, max)
+}
+
+// Frames aren't padded. The default policy.
+type NoPadding struct{}
+
+func (NoPadding) Padding(frameType FrameType, length, max int) int {
+	return 0
+}
+
+// Frames are padded by a fixed number of bytes.
+type FixedPadding int
+
+func (p FixedPadding) Padding(frameType FrameType, length, max int) int {
+	return boundPadding(int(p), max)
+}
+
+// Frames are padded by a uniformly random number of bytes, up to and
+// including the policy's value.
+type RandomPadding int
+
+func (p RandomPadding) Padding(frameType FrameType, length, max int) int {
+	bound := boundPadding(int(p), max)
+	return rand.Intn(bound + 1)
+}
+
+// Frames are padded to the next multiple of the policy's value, so that
+// only the bucket of their length is revealed. The bucket holds the
+// content and padding, and the fields encoding the padding length. A
+// frame whose bucket exceeds max is padded to max.
+type BucketPadding int
+
+func (p BucketPadding) Padding(frameType FrameType, length, max int) int {
+	if p <= 0 {
+		return 0
+	}
+	bucket := int(p)
+	gap := (bucket - length%bucket) % bucket
+	// The gap is filled by the padding and the fields encoding its
+	// length, which can't exactly fill a gap of 1 or 0x101 bytes. The
+	// following bucket is used instead.
+	for gap == 1 || gap == 0xff+2 {
+		gap += bucket
+	}
+	return boundPadding(maxPaddingWithin(gap), max)
+}
+
+func boundPadding(padding, max int) int {
+	if padding > max {
+		padding = max
+	}
+	if padding < 0 {
+		padding = 0
+	}
+	return padding
+}
+
+// Applies Config.Padding to DATA as it's sent, once the frame is known
+// not to be split by flow control, so that padding is chosen from the
+// length of DATA actually sent. DATA already padded by its owner is left
+// as-is. The payload, including the fields encoding the padding length,
+// may not exceed bound, which is further bounded by the frame payload.
+func (c *connection) padData(data *DataFrame, bound int) {
+	if bound > kMaxFramePayload {
+		bound = kMaxFramePayload
+	}
+	max := maxPaddingWithin(bound - len(data.Data))
+	data.PaddingLength = uint16(boundPadding(
+		c.config.Padding.Padding(DATA, len(data.Data), max), max))
+	data.Flags, _ = paddingFlags(data.Flags, data.PaddingLength)
+}
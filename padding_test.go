@@ -0,0 +1,147 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (t *ConnectionTest) TestPaddingPolicies(c *gc.C) {
+	c.Check(NoPadding{}.Padding(DATA, 10, 100), gc.Equals, 0)
+	c.Check(FixedPadding(10).Padding(DATA, 10, 100), gc.Equals, 10)
+	c.Check(FixedPadding(10).Padding(DATA, 10, 4), gc.Equals, 4)
+
+	// The padding length field fills the bucket along with the padding.
+	c.Check(BucketPadding(64).Padding(DATA, 100, 100), gc.Equals, 27)
+	c.Check(BucketPadding(64).Padding(DATA, 63, 100), gc.Equals, 64)
+	c.Check(BucketPadding(64).Padding(DATA, 128, 100), gc.Equals, 0)
+	c.Check(BucketPadding(64).Padding(HEADERS, 0, 100), gc.Equals, 0)
+	c.Check(BucketPadding(64).Padding(DATA, 100, 20), gc.Equals, 20)
+
+	for i := 0; i != 100; i++ {
+		padding := RandomPadding(8).Padding(DATA, 10, 100)
+		c.Check(padding >= 0 && padding <= 8, gc.Equals, true)
+		c.Check(RandomPadding(8).Padding(DATA, 10, 2) <= 2, gc.Equals, true)
+	}
+}
+
+func (t *ConnectionTest) TestDataPaddingChargedToFlowControl(c *gc.C) {
+	t.conn.config.Padding = FixedPadding(6)
+	handle := t.addOwnedStream(1, Open, 100)
+	t.setSendWindow(handle, 100)
+	t.start()
+
+	c.Check((<-t.startWrite(handle, "0123")).n, gc.Equals, 4)
+	data := t.expectSent(c).(*DataFrame)
+	c.Check(string(data.Data), gc.Equals, "0123")
+	c.Check(data.PaddingLength, gc.Equals, uint16(6))
+	// The padding length field is also charged.
+	c.Check(t.expectWindowDelta(c, handle.events), gc.Equals, -11)
+
+	c.Check(t.conn.sendFlowAvailable, gc.Equals, 65535-11)
+	c.Check(t.conn.streams[1].SendFlowAvailable, gc.Equals, 89)
+	c.Check(handle.send.available, gc.Equals, 89)
+	c.Check(handle.send.reserved, gc.Equals, 0)
+}
+
+func (t *ConnectionTest) TestDataPaddingSplitByFlowControl(c *gc.C) {
+	t.conn.config.Padding = BucketPadding(16)
+	t.conn.sendFlowAvailable = 16
+	handle := t.addOwnedStream(1, Open, 100)
+	t.setSendWindow(handle, 100)
+	t.start()
+
+	// DATA exceeding the connection window is split, and each frame
+	// sent is padded to a bucket from the content it carries.
+	c.Check((<-t.startWrite(handle, "0123456789abcdefghij")).n,
+		gc.Equals, 20)
+	data := t.expectSent(c).(*DataFrame)
+	c.Check(string(data.Data), gc.Equals, "0123456789abcdef")
+	c.Check(data.PaddingLength, gc.Equals, uint16(0))
+
+	t.recvMux <- &WindowUpdateFrame{SizeDelta: 100}
+	data = t.expectSent(c).(*DataFrame)
+	c.Check(string(data.Data), gc.Equals, "ghij")
+	c.Check(data.PaddingLength, gc.Equals, uint16(11))
+	t.syncLoop(c)
+	c.Check(t.conn.streams[1].SendFlowAvailable, gc.Equals, 100-32)
+}
+
+func (t *ConnectionTest) TestDataPaddingBoundedByFlowControl(c *gc.C) {
+	t.conn.config.Padding = FixedPadding(6)
+	handle := t.addOwnedStream(1, Open, 100)
+	t.setSendWindow(handle, 12)
+	t.start()
+
+	// Padding is chosen from the window remaining as DATA is sent.
+	c.Check((<-t.startWrite(handle, "0123456789")).n, gc.Equals, 10)
+	data := t.expectSent(c).(*DataFrame)
+	c.Check(string(data.Data), gc.Equals, "0123456789")
+	c.Check(data.PaddingLength, gc.Equals, uint16(1))
+	c.Check(data.PayloadLength(), gc.Equals, 12)
+	t.syncLoop(c)
+	c.Check(t.conn.streams[1].SendFlowAvailable, gc.Equals, 0)
+}
+
+func (t *ConnectionTest) TestRecievedPaddingLengthIsCharged(c *gc.C) {
+	t.addStream(1, Open)
+	t.conn.recvFlow.WinSize = 11
+	t.conn.streams[1].RecvFlow.WinSize = 100
+	t.start()
+
+	// Data and padding fit the window, but the padding length doesn't.
+	t.recvMux <- &DataFrame{
+		FramePrefix:  FramePrefix{StreamID: 1, Flags: PAD_LOW},
+		FramePadding: FramePadding{1},
+		Data:         []byte("0123456789"),
+	}
+	c.Check(t.expectSent(c).(*GoAwayFrame).Error.Code, gc.Equals,
+		FLOW_CONTROL_ERROR)
+	t.expectClosed(c)
+}
+
+func (t *ConnectionTest) TestHeadersPaddedByConfig(c *gc.C) {
+	t.setUp(false)
+	t.conn.config.Padding = BucketPadding(32)
+	t.start()
+
+	_, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Assert(err, gc.IsNil)
+	c.Check(t.expectSent(c).(*HeadersFrame).padding, gc.Equals,
+		PaddingPolicy(BucketPadding(32)))
+}
+
+func (t *FrameWriterTest) TestHeadersPaddedFromEncodedLength(c *gc.C) {
+	policy := BucketPadding(32)
+
+	// The test encoder encodes field values alone.
+	fields := []HeaderField{{Name: ":path", Values: "/index.html"}}
+	t.write(c, &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_HEADERS},
+		Fields:      fields,
+		padding:     policy,
+	})
+	c.Check(t.parse(c).(*HeadersFrame).PaddingLength,
+		gc.Equals, uint16(32-11-1))
+
+	t.write(c, &PushPromiseFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_HEADERS},
+		PromisedID:  2,
+		Fields:      fields,
+		padding:     policy,
+	})
+	c.Check(t.parse(c).(*PushPromiseFrame).PaddingLength,
+		gc.Equals, uint16(32-11-1))
+
+	// Frames already padded by their owner are left as-is.
+	t.write(c, &HeadersFrame{
+		FramePrefix:  FramePrefix{StreamID: 1, Flags: END_HEADERS},
+		FramePadding: FramePadding{PaddingLength: 3},
+		Fields:       fields,
+		padding:      policy,
+	})
+	c.Check(t.parse(c).(*HeadersFrame).PaddingLength, gc.Equals, uint16(3))
+}
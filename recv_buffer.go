@@ -0,0 +1,195 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Buffers DATA recieved on a stream until it's read by the stream's owner.
+// The peer may send no more than the stream's receive window, which is
+// re-opened only as buffered bytes are read and consumed. The buffer is
+// thereby bounded, and mainLoop() never blocks on a slow (or absent)
+// reader: a stream which isn't read stalls only itself.
+type recvBuffer struct {
+	mu       sync.Mutex
+	chunks   []recvChunk   // Guarded by mu.
+	fin      bool          // Guarded by mu. END_STREAM was recieved.
+	trailers []HeaderField // Guarded by mu. Trailers which ended the stream.
+	err      *Error        // Guarded by mu. The stream was reset or abandoned.
+	// Guarded by mu. The owner closed the stream, and recieved
+	// DATA is discarded rather than buffered.
+	discard bool
+
+	// Signaled, without blocking, as data, fin, or an error arrives.
+	ready chan struct{}
+}
+
+// Recieved DATA, which may end a segment of the stream.
+type recvChunk struct {
+	data       []byte
+	endSegment bool
+}
+
+func newRecvBuffer() *recvBuffer {
+	return &recvBuffer{ready: make(chan struct{}, 1)}
+}
+
+// Appends recieved data, which the buffer takes ownership of, and which
+// ends a segment if endSegment. Returns false if the data was discarded
+// instead, and should be consumed.
+func (b *recvBuffer) write(data []byte, endSegment, fin bool) bool {
+	b.mu.Lock()
+	buffered := !b.discard
+	if buffered && (len(data) != 0 || endSegment) {
+		b.chunks = append(b.chunks, recvChunk{data, endSegment})
+	}
+	b.fin = b.fin || fin
+	b.mu.Unlock()
+	b.signal()
+	return buffered
+}
+
+// Ends the stream with trailers, which follow buffered data.
+func (b *recvBuffer) finish(trailers []HeaderField) {
+	b.mu.Lock()
+	b.trailers = trailers
+	b.fin = true
+	b.mu.Unlock()
+	b.signal()
+}
+
+// Returns trailers, once all buffered data has been read.
+func (b *recvBuffer) recievedTrailers() []HeaderField {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.chunks) != 0 || b.err != nil {
+		return nil
+	}
+	return b.trailers
+}
+
+// Discards buffered and subsequently recieved data, and fails reads with
+// err. Returns the number of buffered bytes discarded.
+func (b *recvBuffer) close(err *Error) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := 0
+	for _, chunk := range b.chunks {
+		n += len(chunk.data)
+	}
+	b.chunks = nil
+	b.discard = true
+	if b.err == nil {
+		b.err = err
+	}
+	return n
+}
+
+// Fails subsequent reads with err, discarding buffered data. Returns the
+// number of buffered bytes discarded, if the buffer hadn't already failed.
+func (b *recvBuffer) fail(err *Error) int {
+	b.mu.Lock()
+	n := 0
+	if b.err == nil {
+		for _, chunk := range b.chunks {
+			n += len(chunk.data)
+		}
+		b.err = err
+		b.chunks = nil
+	}
+	b.mu.Unlock()
+	b.signal()
+	return n
+}
+
+func (b *recvBuffer) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Reads buffered data into p without blocking. Returns zero bytes and a
+// nil error if no data is buffered, and the stream has yet to end. If
+// segmented, the read stops at the end of a segment, which is returned
+// as endSegment.
+func (b *recvBuffer) read(p []byte,
+	segmented bool) (n int, endSegment bool, err error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return 0, false, b.err
+	}
+	for len(b.chunks) != 0 && !endSegment {
+		chunk := &b.chunks[0]
+		if n == len(p) && len(chunk.data) != 0 {
+			break
+		}
+		copied := copy(p[n:], chunk.data)
+		n += copied
+		if chunk.data = chunk.data[copied:]; len(chunk.data) == 0 {
+			endSegment = segmented && chunk.endSegment
+			b.chunks = b.chunks[1:]
+		}
+	}
+	if n == 0 && !endSegment && b.fin {
+		return 0, false, io.EOF
+	}
+	return n, endSegment, nil
+}
+
+type windowRequest struct {
+	id    StreamID
+	size  int
+	reply chan<- *Error
+}
+
+// Sets the stream's recieve window, which bounds the DATA buffered
+// ahead of reads. Streams begin with the window of the local
+// SETTINGS_INITIAL_WINDOW_SIZE; a larger window suits, for example, a
+// bulk download. The increase is advertised through WINDOW_UPDATE. The
+// window may not shrink, and is also bounded by the connection window.
+func (h *StreamHandle) SetRecieveWindow(size int) error {
+	reply := make(chan *Error, 1)
+	select {
+	case h.conn.windowMux <- windowRequest{h.ID, size, reply}:
+	case <-h.conn.done:
+		return &Error{Code: CANCEL, Level: RecoverableError,
+			Err: kConnectionClosedError}
+	}
+	if err := <-reply; err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *connection) resizeRecieveWindow(id StreamID, size int) *Error {
+	stream, ok := c.streams[id]
+	if !ok || (stream.State != Idle && stream.State != Open &&
+		stream.State != HalfClosedLocal) {
+		return &Error{Code: STREAM_CLOSED, Level: RecoverableError,
+			Err: kStreamReadClosedError}
+	}
+	if size < stream.RecvFlow.WinSize || size > kMaxWindowSize {
+		return &Error{Code: INTERNAL_ERROR, Level: RecoverableError,
+			Err: fmt.Errorf("recieve window of stream %v can't change "+
+				"from %v to %v", id, stream.RecvFlow.WinSize, size)}
+	}
+	if delta := size - stream.RecvFlow.WinSize; delta != 0 {
+		stream.RecvFlow.WinSize = size
+		// Follows the HEADERS of an Idle stream, which opens it.
+		c.writeQueue.enqueueBack(&WindowUpdateFrame{
+			FramePrefix: FramePrefix{StreamID: id},
+			SizeDelta:   uint32(delta),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+	"io"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (t *ConnectionTest) TestRecievedDataIsBufferedUntilRead(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.conn.recvFlow.WinSize = 200
+	t.start()
+
+	t.recvMux <- &DataFrame{
+		FramePrefix:  FramePrefix{StreamID: 1, Flags: PAD_LOW},
+		FramePadding: FramePadding{5},
+		Data:         []byte("hello "),
+	}
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Data:        []byte("world"),
+	}
+	// Control frames are processed while DATA remains unread.
+	t.recvMux <- &PingFrame{}
+	c.Check(t.expectSent(c).(*PingFrame).Flags, gc.Equals, ACK)
+
+	body, err := io.ReadAll(handle)
+	c.Check(err, gc.IsNil)
+	c.Check(string(body), gc.Equals, "hello world")
+	t.syncLoop(c)
+
+	// Padding and its length field were consumed on receipt, and read
+	// DATA as it was read.
+	c.Check(t.conn.recvFlow.WinUnacked, gc.Equals, 17)
+}
+
+func (t *ConnectionTest) TestReadsReopenRecieveWindow(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.conn.recvFlow.WinSize = 1000
+	t.start()
+
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 100),
+	}
+	// The window is exhausted until DATA is read.
+	buf := make([]byte, 60)
+	n, err := handle.Read(buf)
+	c.Check(n, gc.Equals, 60)
+	c.Check(err, gc.IsNil)
+
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(1))
+	c.Check(update.SizeDelta, gc.Equals, uint32(60))
+
+	// Peer may send the re-opened window.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Data:        make([]byte, 60),
+	}
+	body, err := io.ReadAll(handle)
+	c.Check(err, gc.IsNil)
+	c.Check(body, gc.HasLen, 100)
+}
+
+func (t *ConnectionTest) TestDataBeyondRecieveWindowFailsReads(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.conn.recvFlow.WinSize = 1000
+	t.start()
+
+	for i := 0; i != 2; i++ {
+		t.recvMux <- &DataFrame{
+			FramePrefix: FramePrefix{StreamID: 1},
+			Data:        make([]byte, 60),
+		}
+	}
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, FLOW_CONTROL_ERROR)
+	t.expectClosed(c)
+
+	// Buffered DATA is discarded, and reads fail.
+	_, err := handle.Read(make([]byte, 10))
+	c.Check(err.(*Error).Code, gc.Equals, FLOW_CONTROL_ERROR)
+	c.Check(err.(*Error).Level, gc.Equals, ConnectionError)
+}
+
+func (t *ConnectionTest) TestClosedStreamBufferIsBounded(c *gc.C) {
+	t.conn.recvFlow.WinSize = 100
+	t.addOwnedStream(1, HalfClosedLocal, 100)
+	t.addOwnedStream(3, HalfClosedLocal, 100)
+	t.start()
+
+	// DATA of closed streams which isn't read fills the connection window.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Data:        make([]byte, 100),
+	}
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 3, Flags: END_STREAM},
+		Data:        make([]byte, 10),
+	}
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, FLOW_CONTROL_ERROR)
+	t.expectClosed(c)
+}
+
+func (t *ConnectionTest) TestDiscardedBufferReopensWindow(c *gc.C) {
+	t.conn.recvFlow.WinSize = 100
+	handle := t.addOwnedStream(1, HalfClosedLocal, 100)
+	t.start()
+
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Data:        make([]byte, 60),
+	}
+	t.syncLoop(c)
+	c.Check(t.conn.recvFlow.Unconsumed(), gc.Equals, 60)
+
+	// The closed stream's buffer is discarded by its owner.
+	c.Check(handle.Close(), gc.IsNil)
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(0))
+	c.Check(update.SizeDelta, gc.Equals, uint32(60))
+}
+
+func (t *ConnectionTest) TestCloseFailsBlockedRead(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := handle.Read(make([]byte, 10))
+		result <- err
+	}()
+	t.cancel()
+	t.expectClosed(c)
+
+	err := (<-result).(*Error)
+	c.Check(err.Code, gc.Equals, CANCEL)
+	c.Check(err.Level, gc.Equals, ConnectionError)
+}
+
+func (t *ConnectionTest) TestStreamsTakeInitialRecieveWindow(c *gc.C) {
+	t.start()
+
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 60000),
+	}
+	t.syncLoop(c)
+	c.Check(t.conn.streams[1].RecvFlow.WinSize, gc.Equals, 65535)
+	c.Check(t.conn.streams[1].RecvFlow.WinUsed, gc.Equals, 60000)
+
+	// A change of SETTINGS_INITIAL_WINDOW_SIZE applies to existing and
+	// new streams.
+	t.handle.queueMux <- &SettingsFrame{
+		Settings: map[SettingID]uint32{SETTINGS_INITIAL_WINDOW_SIZE: 100000}}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &SettingsFrame{})
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3}}
+	t.syncLoop(c)
+	c.Check(t.conn.streams[1].RecvFlow.WinSize, gc.Equals, 100000)
+	c.Check(t.conn.streams[3].RecvFlow.WinSize, gc.Equals, 100000)
+}
+
+func (t *ConnectionTest) TestRecieveWindowDecreasesOnAck(c *gc.C) {
+	t.start()
+
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.handle.queueMux <- &SettingsFrame{
+		Settings: map[SettingID]uint32{SETTINGS_INITIAL_WINDOW_SIZE: 100}}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &SettingsFrame{})
+
+	// Until the peer acknowledges the decrease, it may use the prior window.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 60000),
+	}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 3}}
+	t.syncLoop(c)
+	c.Check(t.conn.streams[1].RecvFlow.WinSize, gc.Equals, 65535)
+	c.Check(t.conn.streams[3].RecvFlow.WinSize, gc.Equals, 65535)
+
+	// The initial SETTINGS are acknowledged, and then the decrease.
+	t.recvMux <- &SettingsFrame{FramePrefix: FramePrefix{Flags: ACK}}
+	t.syncLoop(c)
+	c.Check(t.conn.streams[1].RecvFlow.WinSize, gc.Equals, 65535)
+
+	t.recvMux <- &SettingsFrame{FramePrefix: FramePrefix{Flags: ACK}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 5}}
+	t.syncLoop(c)
+	c.Check(t.conn.streams[1].RecvFlow.WinSize, gc.Equals, 100)
+	c.Check(t.conn.streams[3].RecvFlow.WinSize, gc.Equals, 100)
+	c.Check(t.conn.streams[5].RecvFlow.WinSize, gc.Equals, 100)
+}
+
+func (t *ConnectionTest) TestSetRecieveWindow(c *gc.C) {
+	t.setUp(false)
+	t.start()
+
+	stream, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Assert(err, gc.IsNil)
+	c.Check(stream.SetRecieveWindow(1<<20), gc.IsNil)
+
+	// The increase is advertised once the stream is opened.
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &HeadersFrame{})
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, stream.ID)
+	c.Check(update.SizeDelta, gc.Equals, uint32(1<<20-65535))
+
+	// The window may not shrink.
+	c.Check(stream.SetRecieveWindow(1000), gc.ErrorMatches,
+		"recieve window of stream 1 can't change from 1048576 to 1000")
+
+	// Nor be set once the peer has ended the stream.
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: stream.ID, Flags: END_STREAM}}
+	c.Check(stream.SetRecieveWindow(1<<21).(*Error).Code, gc.Equals,
+		STREAM_CLOSED)
+}
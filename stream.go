@@ -3,6 +3,10 @@
 // found in the LICENSE file.
 package http2
 
+import (
+	"sync"
+)
+
 type StreamState uint8
 
 type SendOrReceive bool
@@ -44,14 +48,98 @@ func (s StreamState) String() string {
 	}
 }
 
+// Whether streams in the state count toward the
+// SETTINGS_MAX_CONCURRENT_STREAMS limit of their initiator's peer.
+func (s StreamState) countsTowardConcurrency() bool {
+	return s == Open || s == HalfClosedLocal || s == HalfClosedRemote
+}
+
+func (s StreamState) isClosed() bool {
+	return s == Closed || s == ClosedWithSentReset
+}
+
+// Counts of a connection's streams by state, updated as streams
+// transition so that streams needn't be scanned on each loop iteration.
+type streamCounts struct {
+	// Streams which are neither idle nor closed.
+	active int
+	// Closed streams, awaiting retirement.
+	closed []StreamID
+}
+
+func (n *streamCounts) add(stream *Stream) {
+	n.onTransition(stream.ID, Idle, stream.State)
+}
+
+func (n *streamCounts) onTransition(id StreamID, from, to StreamState) {
+	if from != Idle && !from.isClosed() {
+		n.active -= 1
+	}
+	if to != Idle && !to.isClosed() {
+		n.active += 1
+	}
+	if !from.isClosed() && to.isClosed() {
+		n.closed = append(n.closed, id)
+	}
+}
+
 type Stream struct {
 	ID    StreamID
 	State StreamState
 
 	RecvFlow RecieveFlow
+	// Whether the stream's initial HEADERS were recieved. A later
+	// HEADERS carries trailers. Interim (1xx) responses aren't counted.
+	headersRecieved bool
+	// Number of interim responses recieved.
+	informationalRecieved int
+	// Whether HEADERS other than an interim response were sent.
+	headersSent bool
 
 	SendFlowAvailable int
-	SendFlowPump      chan<- int
+
+	// Receives the error which terminated the stream, if the stream was
+	// abandoned rather than closing normally.
+	ErrorPump chan<- *Error
+
+	// DATA recieved on the stream, not yet read by the owner.
+	recv *recvBuffer
+	// Send window, as mirrored to the owner.
+	send *sendWindow
+	// Events delivered to the owner.
+	events *streamEvents
+	// Owner's handle of a stream opened by the peer, until it's
+	// handed to Config.OnStream.
+	owner *StreamHandle
+
+	// Counts of the connection's streams, updated on each transition.
+	counts *streamCounts
+	// Recieves StreamTransitionEvents, if Config.TraceStreams.
+	tracer EventHook
+	// Transitions of the stream, if traced.
+	transitions      []StreamTransition
+	panicOnInvariant bool
+}
+
+// Owner's handle to a Stream. Implements io.ReadWriteCloser, reading
+// recieved DATA and writing DATA subject to flow control.
+type StreamHandle struct {
+	ID StreamID
+
+	// Recieves the error which terminated the stream, if any.
+	ErrorPump <-chan *Error
+
+	conn *Connection
+	recv *recvBuffer
+	send *sendWindow
+
+	events     *streamEvents
+	eventsOnce sync.Once
+	eventsOut  chan StreamEvent
+
+	readDeadline      *streamDeadline
+	writeDeadline     *streamDeadline
+	deadlineResetOnce sync.Once
 }
 
 func (s *Stream) frameError(dir SendOrReceive, frameType FrameType) *Error {
@@ -85,10 +173,9 @@ func (s *Stream) onPushPromise(dir SendOrReceive) *Error {
 	}
 
 	if dir == Send {
-		s.State = ReservedLocal
+		s.setState(ReservedLocal, PUSH_PROMISE, dir)
 	} else {
-		s.State = ReservedRemote
-		close(s.SendFlowPump)
+		s.setState(ReservedRemote, PUSH_PROMISE, dir)
 	}
 	return nil
 }
@@ -103,28 +190,36 @@ func (s *Stream) onHeaders(dir SendOrReceive, fin bool) *Error {
 		return s.frameError(dir, HEADERS)
 	}
 
-	localOpen := false
+	// Whether the stream opened for sending, by either endpoint.
+	sendOpened := false
 
 	if s.State == Idle {
-		s.State = Open
-		localOpen = true
+		s.setState(Open, HEADERS, dir)
+		sendOpened = true
 	} else if s.State == ReservedLocal {
-		s.State = HalfClosedRemote
-		localOpen = true
+		s.setState(HalfClosedRemote, HEADERS, dir)
+		sendOpened = true
 	} else if s.State == ReservedRemote {
-		s.State = HalfClosedLocal
+		s.setState(HalfClosedLocal, HEADERS, dir)
 	}
 
 	if fin && dir == Send {
-		s.onLocalFin()
-		localOpen = false
+		if err := s.onLocalFin(HEADERS); err != nil {
+			return err
+		}
+		sendOpened = false
 	} else if fin {
-		s.onRemoteFin()
+		if err := s.onRemoteFin(HEADERS); err != nil {
+			return err
+		}
 	}
 
-	if localOpen {
-		// Stream was locally opened, and remains open.
-		s.SendFlowPump <- s.SendFlowAvailable
+	if sendOpened {
+		// The stream was opened, and remains open for sending.
+		s.events.push(&WindowEvent{
+			Delta:     s.SendFlowAvailable,
+			Available: s.SendFlowAvailable,
+		})
 	}
 	return nil
 }
@@ -137,50 +232,90 @@ func (s *Stream) onData(dir SendOrReceive, fin bool) *Error {
 	}
 
 	if dir == Send && fin {
-		s.onLocalFin()
+		return s.onLocalFin(DATA)
 	} else if fin {
-		s.onRemoteFin()
+		return s.onRemoteFin(DATA)
 	}
 	return nil
 }
 
-func (s *Stream) onReset(dir SendOrReceive) *Error {
+// Transitions the stream on a sent or recieved RST_STREAM. The owner
+// of an unclosed stream is informed of err.
+func (s *Stream) onReset(dir SendOrReceive, err *Error) *Error {
 	if s.State == Idle ||
 		s.State == ClosedWithSentReset {
 		return s.frameError(dir, RST_STREAM)
 	}
 
-	if s.State != ReservedRemote &&
-		s.State != HalfClosedLocal &&
-		s.State != Closed &&
-		s.State != ClosedWithSentReset {
-		close(s.SendFlowPump)
+	if s.State != Closed {
+		s.events.push(&ResetEvent{err})
+		s.events.push(&ClosedEvent{})
 	}
 	if dir == Receive {
-		s.State = Closed
+		s.setState(Closed, RST_STREAM, dir)
 	} else {
-		s.State = ClosedWithSentReset
+		s.setState(ClosedWithSentReset, RST_STREAM, dir)
+	}
+	return nil
+}
+
+// Closes the stream without further frames being sent or received,
+// and informs the stream owner of err.
+func (s *Stream) abandon(err *Error) {
+	if s.State != Closed && s.State != ClosedWithSentReset {
+		s.events.push(&ResetEvent{err})
+		s.events.push(&ClosedEvent{})
+	}
+	s.setStateImplicitly(Closed)
+	s.ErrorPump <- err
+	s.send.fail(err)
+	s.recv.fail(err)
+}
+
+// Applies a change to the stream's send window, as from a WINDOW_UPDATE
+// or a change of the peer's SETTINGS_INITIAL_WINDOW_SIZE. An owner of
+// an opened stream is informed of the change.
+func (s *Stream) onSendFlowDelta(delta int) *Error {
+	if s.SendFlowAvailable+delta > kMaxWindowSize {
+		err := flowControlError("stream %v send window overflow (%v + %v)",
+			s.ID, s.SendFlowAvailable, delta)
+		err.Level = StreamError
+		return err
+	}
+	s.SendFlowAvailable += delta
+	s.send.adjust(delta)
+
+	if s.State == Open || s.State == HalfClosedRemote {
+		s.events.push(&WindowEvent{Delta: delta, Available: s.SendFlowAvailable})
 	}
 	return nil
 }
 
-func (s *Stream) onRemoteFin() {
+// Ends the stream's recieved frames, on END_STREAM of the frame type.
+// The frame must have been validated against the stream's state.
+func (s *Stream) onRemoteFin(frame FrameType) *Error {
 	if s.State == Open {
-		s.State = HalfClosedRemote
+		s.setState(HalfClosedRemote, frame, Receive)
 	} else if s.State == HalfClosedLocal {
-		s.State = Closed
+		s.setState(Closed, frame, Receive)
+		s.events.push(&ClosedEvent{})
 	} else {
-		panic(s.State)
+		return s.invariantViolated("recieved END_STREAM of %v in state %v",
+			frame, s.State)
 	}
+	return nil
 }
 
-func (s *Stream) onLocalFin() {
+// Ends the stream's sent frames, as onRemoteFin().
+func (s *Stream) onLocalFin(frame FrameType) *Error {
 	if s.State == Open {
-		s.State = HalfClosedLocal
+		s.setState(HalfClosedLocal, frame, Send)
 	} else if s.State == HalfClosedRemote {
-		s.State = Closed
+		s.setState(Closed, frame, Send)
+		s.events.push(&ClosedEvent{})
 	} else {
-		panic(s.State)
+		return s.invariantViolated("sent END_STREAM of %v in state %v",
+			frame, s.State)
 	}
-	close(s.SendFlowPump)
+	return nil
 }
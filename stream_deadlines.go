@@ -0,0 +1,98 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Deadline of a stream's reads or writes. The expired channel is closed
+// once the deadline passes, and replaced if the deadline is extended.
+type streamDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newStreamDeadline() *streamDeadline {
+	return &streamDeadline{expired: make(chan struct{})}
+}
+
+// Sets the deadline. The zero time clears it.
+func (d *streamDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // Timer fired. Wait for it to close expired.
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.expired:
+		expired = true
+	default:
+	}
+
+	if t.IsZero() {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+	} else if remaining := time.Until(t); remaining > 0 {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		expiredCh := d.expired
+		d.timer = time.AfterFunc(remaining, func() { close(expiredCh) })
+	} else if !expired {
+		close(d.expired)
+	}
+}
+
+// Returns a channel which is closed once the deadline passes.
+func (d *streamDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+// Sets the deadline of reads and writes. See SetReadDeadline()
+// and SetWriteDeadline().
+func (h *StreamHandle) SetDeadline(t time.Time) error {
+	h.readDeadline.set(t)
+	h.writeDeadline.set(t)
+	return nil
+}
+
+// Sets the deadline of pending and future reads. Once it passes, reads
+// fail with an *Error wrapping os.ErrDeadlineExceeded, and the stream
+// is reset if Config.ResetStreamOnDeadline. The zero time clears it.
+func (h *StreamHandle) SetReadDeadline(t time.Time) error {
+	h.readDeadline.set(t)
+	return nil
+}
+
+// Sets the deadline of pending and future writes, as SetReadDeadline().
+// A write which times out may have queued part of its data.
+func (h *StreamHandle) SetWriteDeadline(t time.Time) error {
+	h.writeDeadline.set(t)
+	return nil
+}
+
+// Fails an operation whose deadline passed. The stream is reset by
+// the first operation to time out, if Config.ResetStreamOnDeadline.
+func (h *StreamHandle) deadlineExceeded() *Error {
+	if h.conn.config.ResetStreamOnDeadline {
+		var err *Error
+		h.deadlineResetOnce.Do(func() { err = h.reset(CANCEL) })
+		if err != nil {
+			return err
+		}
+	}
+	return &Error{Code: CANCEL, Level: RecoverableError,
+		Err: os.ErrDeadlineExceeded}
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (t *ConnectionTest) TestReadDeadline(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	// A pending read is unblocked.
+	handle.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := handle.Read(make([]byte, 10))
+	c.Check(errors.Is(err, os.ErrDeadlineExceeded), gc.Equals, true)
+	c.Check(err.(*Error).Level, gc.Equals, RecoverableError)
+
+	// As are reads of buffered data.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        []byte("data"),
+	}
+	t.syncLoop(c)
+	_, err = handle.Read(make([]byte, 10))
+	c.Check(errors.Is(err, os.ErrDeadlineExceeded), gc.Equals, true)
+
+	// The stream wasn't reset, and may be read once the deadline clears.
+	handle.SetReadDeadline(time.Time{})
+	n, err := handle.Read(make([]byte, 10))
+	c.Check(n, gc.Equals, 4)
+	c.Check(err, gc.IsNil)
+	c.Check(t.streamState(1), gc.Equals, Open)
+}
+
+func (t *ConnectionTest) TestWriteDeadlineResetsStream(c *gc.C) {
+	t.handle.config.ResetStreamOnDeadline = true
+	handle := t.addOwnedStream(1, Open, 100)
+	t.setSendWindow(handle, 0)
+	t.start()
+
+	result := t.startWrite(handle, "stalled")
+	handle.SetWriteDeadline(time.Now())
+
+	written := <-result
+	c.Check(written.n, gc.Equals, 0)
+	c.Check(errors.Is(written.err, os.ErrDeadlineExceeded), gc.Equals, true)
+
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, CANCEL)
+
+	_, err := handle.Read(make([]byte, 10))
+	c.Check(err.(*Error).Code, gc.Equals, CANCEL)
+	c.Check(err.(*Error).Level, gc.Equals, StreamError)
+}
+
+func (t *ConnectionTest) TestDeadlineResetsStreamOnce(c *gc.C) {
+	t.handle.config.ResetStreamOnDeadline = true
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	handle.SetReadDeadline(time.Now())
+	for i := 0; i != 2; i++ {
+		_, err := handle.Read(make([]byte, 10))
+		c.Check(errors.Is(err, os.ErrDeadlineExceeded), gc.Equals, true)
+	}
+	c.Check(t.expectSent(c).(*RstStreamFrame).Error.Code, gc.Equals, CANCEL)
+
+	// Nor is the stream reset again by a timed-out write.
+	handle.SetWriteDeadline(time.Now())
+	_, err := handle.Write([]byte("data"))
+	c.Check(errors.Is(err, os.ErrDeadlineExceeded), gc.Equals, true)
+
+	t.recvMux <- &PingFrame{}
+	c.Check(t.expectSent(c).(*PingFrame).Flags, gc.Equals, ACK)
+}
+
+func (t *ConnectionTest) TestExtendedDeadline(c *gc.C) {
+	deadline := newStreamDeadline()
+
+	deadline.set(time.Now().Add(-time.Second))
+	expired := deadline.wait()
+	<-expired
+
+	// Extending the deadline replaces the expired channel.
+	deadline.set(time.Now().Add(time.Hour))
+	select {
+	case <-deadline.wait():
+		c.Error("deadline expired")
+	default:
+	}
+	deadline.set(time.Now().Add(time.Millisecond))
+	<-deadline.wait()
+}
@@ -0,0 +1,187 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Bound of events held for a slow owner, past which window and data
+// events are coalesced with earlier events of the same type.
+const kMaxPendingStreamEvents = 64
+
+// An event of a stream, delivered to its owner. One of *WindowEvent,
+// *HeadersEvent, *DataEvent, *ResetEvent, or *ClosedEvent.
+type StreamEvent interface {
+	fmt.Stringer
+	isStreamEvent()
+}
+
+// The stream's send window opened or was consumed by Delta bytes,
+// leaving Available. The first WindowEvent of a stream opened by either
+// endpoint carries its initial window, unless the stream was opened
+// already closed for sending.
+type WindowEvent struct {
+	Delta, Available int
+}
+
+// HEADERS were recieved on the stream.
+type HeadersEvent struct {
+	Fields []HeaderField
+	// Whether the fields are trailers, following the stream's DATA.
+	Trailers bool
+	// Whether the fields are an interim (1xx) response.
+	Informational bool
+}
+
+// Length bytes of DATA were recieved, and are available to be read.
+type DataEvent struct {
+	Length int
+}
+
+// The stream was reset by either endpoint, or abandoned with Err.
+type ResetEvent struct {
+	Err *Error
+}
+
+// The stream closed. No further events are delivered.
+type ClosedEvent struct{}
+
+func (*WindowEvent) isStreamEvent()  {}
+func (*HeadersEvent) isStreamEvent() {}
+func (*DataEvent) isStreamEvent()    {}
+func (*ResetEvent) isStreamEvent()   {}
+func (*ClosedEvent) isStreamEvent()  {}
+
+func (e *WindowEvent) String() string {
+	return fmt.Sprintf("WindowEvent{%+d, available %v}", e.Delta, e.Available)
+}
+func (e *HeadersEvent) String() string {
+	return fmt.Sprintf("HeadersEvent{%v, trailers %v, informational %v}",
+		e.Fields, e.Trailers, e.Informational)
+}
+func (e *DataEvent) String() string {
+	return fmt.Sprintf("DataEvent{%v}", e.Length)
+}
+func (e *ResetEvent) String() string {
+	return fmt.Sprintf("ResetEvent{%v}", e.Err)
+}
+func (e *ClosedEvent) String() string {
+	return "ClosedEvent{}"
+}
+
+// Queue of a stream's events. Pushed by mainLoop() without blocking,
+// and popped by the owner.
+type streamEvents struct {
+	mu      sync.Mutex
+	pending []StreamEvent // Guarded by mu.
+	closed  bool          // Guarded by mu. ClosedEvent was pushed.
+
+	// Signaled, without blocking, as events are pushed.
+	ready chan struct{}
+}
+
+func newStreamEvents() *streamEvents {
+	return &streamEvents{ready: make(chan struct{}, 1)}
+}
+
+// Queues the event. Events following ClosedEvent are dropped.
+func (e *streamEvents) push(event StreamEvent) {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	if _, ok := event.(*ClosedEvent); ok {
+		e.closed = true
+	}
+	if len(e.pending) < kMaxPendingStreamEvents || !e.coalesce(event) {
+		e.pending = append(e.pending, event)
+	}
+	e.mu.Unlock()
+
+	select {
+	case e.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Merges a window or data event into the latest pending event of its
+// type. Returns false if it couldn't be merged.
+func (e *streamEvents) coalesce(event StreamEvent) bool {
+	for i := len(e.pending) - 1; i >= 0; i-- {
+		switch prior := e.pending[i].(type) {
+		case *WindowEvent:
+			if window, ok := event.(*WindowEvent); ok {
+				e.pending[i] = &WindowEvent{
+					Delta:     prior.Delta + window.Delta,
+					Available: window.Available,
+				}
+				return true
+			}
+		case *DataEvent:
+			if data, ok := event.(*DataEvent); ok {
+				e.pending[i] = &DataEvent{Length: prior.Length + data.Length}
+				return true
+			}
+		default:
+			// Events may not be reordered past other types.
+			return false
+		}
+	}
+	return false
+}
+
+// Pops the next event, blocking until one is pushed or cancel is
+// closed. Returns false once ClosedEvent has been popped, or on cancel.
+func (e *streamEvents) next(cancel <-chan struct{}) (StreamEvent, bool) {
+	for {
+		e.mu.Lock()
+		if len(e.pending) != 0 {
+			event := e.pending[0]
+			e.pending[0] = nil
+			e.pending = e.pending[1:]
+			e.mu.Unlock()
+			return event, true
+		}
+		closed := e.closed
+		e.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-e.ready:
+		case <-cancel:
+			return nil, false
+		}
+	}
+}
+
+// Returns a channel of the stream's events, which is closed following
+// ClosedEvent. Every stream eventually closes, if only because its
+// connection does. The owner should receive until the channel is closed,
+// and events never block the connection while it does so. Once the
+// connection has closed, events not yet recieved may be dropped.
+func (h *StreamHandle) Events() <-chan StreamEvent {
+	h.eventsOnce.Do(func() {
+		h.eventsOut = make(chan StreamEvent)
+		go func() {
+			defer close(h.eventsOut)
+			for {
+				event, ok := h.events.next(h.conn.done)
+				if !ok {
+					return
+				}
+				select {
+				case h.eventsOut <- event:
+				case <-h.conn.done:
+					return
+				}
+			}
+		}()
+	})
+	return h.eventsOut
+}
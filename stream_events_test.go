@@ -0,0 +1,110 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (t *ConnectionTest) TestStreamEvents(c *gc.C) {
+	t.setUp(false)
+	t.start()
+
+	stream, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Assert(err, gc.IsNil)
+	t.expectSent(c)
+
+	fields := []HeaderField{{Name: ":status", Values: "200"}}
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: stream.ID},
+		Fields:      fields,
+	}
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: stream.ID}, SizeDelta: 10}
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: stream.ID},
+		Error:       Error{Code: CANCEL},
+	}
+
+	var events []StreamEvent
+	for event := range stream.Events() {
+		events = append(events, event)
+	}
+	c.Assert(events, gc.HasLen, 5)
+	c.Check(events[0], gc.DeepEquals, &WindowEvent{65535, 65535})
+	c.Check(events[1], gc.DeepEquals, &HeadersEvent{Fields: fields})
+	c.Check(events[2], gc.DeepEquals, &WindowEvent{10, 65545})
+	c.Check(events[3].(*ResetEvent).Err.Code, gc.Equals, CANCEL)
+	c.Check(events[4], gc.DeepEquals, &ClosedEvent{})
+
+	// Repeated calls return the same, closed channel.
+	_, ok := <-stream.Events()
+	c.Check(ok, gc.Equals, false)
+}
+
+func (t *ConnectionTest) TestUnreadEventsEndWithConnection(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	// Events are never recieved by the owner. Their goroutine exits
+	// once the connection closes, as checked by TearDownTest().
+	handle.Events()
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 1}, SizeDelta: 10}
+	t.syncLoop(c)
+}
+
+func (t *ConnectionTest) TestStreamEventsOfRecievedFrames(c *gc.C) {
+	events, _ := t.addStream(1, HalfClosedLocal)
+	t.conn.recvFlow.WinSize = 100
+	t.conn.streams[1].RecvFlow.WinSize = 100
+	t.start()
+
+	trailers := []HeaderField{{Name: "grpc-status", Values: "0"}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        []byte("data"),
+	}
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Fields:      trailers,
+	}
+	c.Check(t.expectEvent(c, events), gc.DeepEquals, &HeadersEvent{})
+	c.Check(t.expectEvent(c, events), gc.DeepEquals, &DataEvent{4})
+	c.Check(t.expectEvent(c, events), gc.DeepEquals,
+		&HeadersEvent{Fields: trailers, Trailers: true})
+	c.Check(t.expectEvent(c, events), gc.DeepEquals, &ClosedEvent{})
+}
+
+func (t *ConnectionTest) TestStreamEventsAreCoalesced(c *gc.C) {
+	events := newStreamEvents()
+	events.push(&HeadersEvent{})
+	for i := 0; i != kMaxPendingStreamEvents; i++ {
+		events.push(&WindowEvent{Delta: -1, Available: 100 - i})
+		events.push(&DataEvent{Length: 2})
+	}
+	events.push(&ResetEvent{})
+	events.push(&DataEvent{Length: 3})
+	events.push(&ClosedEvent{})
+	events.push(&DataEvent{Length: 4}) // Dropped.
+
+	// Events beyond the bound are merged, but not past HEADERS or RST_STREAM.
+	c.Check(events.pending, gc.HasLen, kMaxPendingStreamEvents+3)
+	c.Check(events.pending[kMaxPendingStreamEvents-2], gc.DeepEquals,
+		&DataEvent{Length: 68})
+	c.Check(events.pending[kMaxPendingStreamEvents-1], gc.DeepEquals,
+		&WindowEvent{Delta: -33, Available: 37})
+	c.Check(events.pending[kMaxPendingStreamEvents+1], gc.DeepEquals,
+		&DataEvent{Length: 3})
+
+	for range events.pending {
+		_, ok := events.next(nil)
+		c.Check(ok, gc.Equals, true)
+	}
+	_, ok := events.next(nil)
+	c.Check(ok, gc.Equals, false)
+}
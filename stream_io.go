@@ -0,0 +1,342 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	kStreamWriteClosedError error = errors.New("Stream closed for writing")
+	kStreamReadClosedError  error = errors.New("Stream closed for reading")
+)
+
+// Mirrors a stream's send window for its owner. The owner may queue DATA
+// only while the window has capacity which isn't already reserved by
+// queued DATA, so writes block on flow control rather than queuing
+// without bound.
+type sendWindow struct {
+	mu        sync.Mutex
+	available int    // Guarded by mu. Mirrors Stream.SendFlowAvailable.
+	reserved  int    // Guarded by mu. DATA queued by the owner, not yet sent.
+	closed    bool   // Guarded by mu. No further DATA may be sent.
+	err       *Error // Guarded by mu. The stream was reset or abandoned.
+	// Guarded by mu. HEADERS other than an interim response were queued.
+	headersSent bool
+
+	// Signaled, without blocking, as the window opens or the stream ends.
+	ready chan struct{}
+}
+
+func newSendWindow(available int) *sendWindow {
+	return &sendWindow{available: available, ready: make(chan struct{}, 1)}
+}
+
+// Applies a change to the window, from WINDOW_UPDATE or SETTINGS.
+func (w *sendWindow) adjust(delta int) {
+	w.mu.Lock()
+	w.available += delta
+	w.mu.Unlock()
+	w.signal()
+}
+
+// Charges n bytes of reserved DATA which were sent, along with their
+// padding (and the fields encoding its length). Padding is chosen by the
+// connection, and isn't reserved.
+func (w *sendWindow) charge(n, padding int) {
+	w.mu.Lock()
+	w.available -= n + padding
+	w.reserved -= n
+	w.mu.Unlock()
+}
+
+// Marks the stream's initial (non-interim) HEADERS as queued. Returns
+// false if they already were.
+func (w *sendWindow) sendHeaders() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sent := w.headersSent
+	w.headersSent = true
+	return !sent
+}
+
+// Whether the stream's initial (non-interim) HEADERS were queued.
+func (w *sendWindow) sentHeaders() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.headersSent
+}
+
+// Marks the window closed, following END_STREAM. Returns false if it
+// was already closed, along with the error which failed it (if any).
+func (w *sendWindow) close() (bool, *Error) {
+	w.mu.Lock()
+	wasOpen := !w.closed
+	w.closed = true
+	err := w.err
+	w.mu.Unlock()
+	w.signal()
+	return wasOpen && err == nil, err
+}
+
+// Fails subsequent writes with err. Returns whether the window
+// hadn't already failed.
+func (w *sendWindow) fail(err *Error) bool {
+	w.mu.Lock()
+	first := w.err == nil
+	if first {
+		w.err = err
+	}
+	w.closed = true
+	w.mu.Unlock()
+	w.signal()
+	return first
+}
+
+func (w *sendWindow) signal() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Reserves up to max bytes of the window without blocking. Returns zero
+// bytes and a nil error if the window has no unreserved capacity.
+func (w *sendWindow) reserve(max int) (int, *Error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	} else if w.closed {
+		return 0, &Error{Code: STREAM_CLOSED, Level: RecoverableError,
+			Err: kStreamWriteClosedError}
+	}
+	n := w.available - w.reserved
+	if n > max {
+		n = max
+	} else if n < 0 {
+		n = 0
+	}
+	w.reserved += n
+	return n, nil
+}
+
+// Reads DATA recieved on the stream. Read blocks until data is available
+// or the read deadline passes, and returns io.EOF once the peer has ended
+// the stream. If the stream is reset or abandoned, the *Error which
+// terminated it is returned. Bytes read are consumed, re-opening the
+// stream and connection windows.
+func (h *StreamHandle) Read(p []byte) (int, error) {
+	n, _, err := h.read(p, false)
+	return n, err
+}
+
+// Reads DATA of the current segment, as Read(). The read stops at the
+// end of the segment, marked by END_SEGMENT, and endSegment reports that
+// the segment's final byte was read. A segment may be empty, in which
+// case zero bytes are read.
+func (h *StreamHandle) ReadSegment(p []byte) (n int, endSegment bool,
+	err error) {
+
+	return h.read(p, true)
+}
+
+func (h *StreamHandle) read(p []byte, segmented bool) (int, bool, error) {
+	if len(p) == 0 {
+		return 0, false, nil
+	}
+	for {
+		select {
+		case <-h.readDeadline.wait():
+			return 0, false, h.deadlineExceeded()
+		default:
+		}
+		n, endSegment, err := h.recv.read(p, segmented)
+		if n != 0 {
+			h.conn.consume(h.ID, n)
+		}
+		if n != 0 || endSegment {
+			return n, endSegment, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		select {
+		case <-h.recv.ready:
+		case <-h.readDeadline.wait():
+		}
+	}
+}
+
+// Writes p as DATA of the stream, queued in frames of at most the
+// connection's MaxDataPayload. Write blocks while the stream's send
+// window is exhausted, or until the write deadline passes. If the stream
+// is reset or abandoned, the *Error which terminated it is returned.
+func (h *StreamHandle) Write(p []byte) (int, error) {
+	return h.write(p, false)
+}
+
+// Writes p as DATA of the stream, as Write(), and ends the current
+// segment by setting END_SEGMENT on its final frame. p may be empty.
+// Segments are preserved by intermediaries which re-frame DATA.
+func (h *StreamHandle) WriteSegment(p []byte) (int, error) {
+	return h.write(p, true)
+}
+
+func (h *StreamHandle) write(p []byte, endSegment bool) (int, error) {
+	if err := h.checkHeadersSent(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) != 0 || endSegment {
+		select {
+		case <-h.writeDeadline.wait():
+			return written, h.deadlineExceeded()
+		default:
+		}
+		bound := len(p)
+		if bound > h.conn.config.MaxDataPayload {
+			bound = h.conn.config.MaxDataPayload
+		}
+		n, err := h.send.reserve(bound)
+		if err != nil {
+			return written, err
+		} else if n == 0 && bound != 0 {
+			// Stalled on flow control.
+			select {
+			case <-h.send.ready:
+			case <-h.writeDeadline.wait():
+			}
+			continue
+		}
+		data := &DataFrame{
+			FramePrefix: FramePrefix{StreamID: h.ID},
+			Data:        append([]byte(nil), p[:n]...),
+		}
+		if p = p[n:]; len(p) == 0 && endSegment {
+			data.Flags |= END_SEGMENT
+			endSegment = false
+		}
+		if err := h.conn.queue(data); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Queues the response of a stream opened by the peer, which is ended
+// if fin. Interim (1xx) responses are queued with WriteInformational(),
+// and trailers with WriteTrailers(). Writes and closes of the stream
+// fail until the response is queued.
+func (h *StreamHandle) WriteHeaders(fields []HeaderField, fin bool) error {
+	if isInformational(fields) {
+		return &Error{Code: INTERNAL_ERROR, Level: RecoverableError,
+			Err: fmt.Errorf("interim response of stream %v isn't final",
+				h.ID)}
+	} else if !h.send.sendHeaders() {
+		return &Error{Code: INTERNAL_ERROR, Level: RecoverableError,
+			Err: fmt.Errorf("headers of stream %v were already sent", h.ID)}
+	}
+	headers := &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: h.ID},
+		Fields:      fields,
+	}
+	if fin {
+		if closing, err := h.send.close(); err != nil {
+			return err
+		} else if !closing {
+			return &Error{Code: STREAM_CLOSED, Level: RecoverableError,
+				Err: kStreamWriteClosedError}
+		}
+		headers.Flags |= END_STREAM
+	}
+	if err := h.conn.queue(headers); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DATA, END_STREAM and trailers of a stream opened by the peer may
+// only follow its response HEADERS. Streams opened locally sent HEADERS
+// as they opened.
+func (h *StreamHandle) checkHeadersSent() *Error {
+	if h.send.sentHeaders() {
+		return nil
+	}
+	return &Error{Code: INTERNAL_ERROR, Level: RecoverableError,
+		Err: fmt.Errorf("response headers of stream %v weren't sent", h.ID)}
+}
+
+// Ends the stream's DATA, queuing END_STREAM to follow DATA already
+// written. Subsequent writes fail. The stream may still be read.
+func (h *StreamHandle) CloseWrite() error {
+	if err := h.checkHeadersSent(); err != nil {
+		return err
+	}
+	if closing, err := h.send.close(); err != nil {
+		return err
+	} else if !closing {
+		return nil
+	}
+	if err := h.conn.queue(&DataFrame{
+		FramePrefix: FramePrefix{StreamID: h.ID, Flags: END_STREAM},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Closes the stream. Written DATA is followed by END_STREAM, as with
+// CloseWrite(). DATA recieved thereafter is discarded, returning it to
+// the peer's window, and subsequent reads fail. Use Reset() to abort the
+// stream instead.
+func (h *StreamHandle) Close() error {
+	err := h.CloseWrite()
+	if n := h.recv.close(&Error{Code: STREAM_CLOSED, Level: RecoverableError,
+		Err: kStreamReadClosedError}); n != 0 {
+		h.conn.consume(h.ID, n)
+	}
+	return err
+}
+
+// Resets the stream with RST_STREAM of the code. Pending and subsequent
+// reads and writes fail, and DATA not yet written is discarded. Resetting
+// a stream which was already reset or abandoned has no effect.
+func (h *StreamHandle) Reset(code ErrorCode) error {
+	if err := h.reset(code); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *StreamHandle) reset(code ErrorCode) *Error {
+	err := &Error{Code: code, Level: StreamError,
+		Err: fmt.Errorf("stream %v reset (%v)", h.ID, code)}
+	if !h.send.fail(err) {
+		return nil
+	}
+	if n := h.recv.fail(err); n != 0 {
+		h.conn.consume(h.ID, n)
+	}
+
+	return h.conn.queue(&RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: h.ID},
+		Error:       Error{Code: code},
+	})
+}
+
+// Queues a frame of a stream to be written. Fails if the
+// connection has closed.
+func (c *Connection) queue(frame Frame) *Error {
+	select {
+	case c.queueMux <- frame:
+		return nil
+	case <-c.done:
+		return &Error{Code: CANCEL, Level: RecoverableError,
+			Err: kConnectionClosedError}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+	"io"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type writeResult struct {
+	n   int
+	err error
+}
+
+func (t *ConnectionTest) startWrite(handle *StreamHandle,
+	p string) <-chan writeResult {
+
+	result := make(chan writeResult, 1)
+	go func() {
+		n, err := handle.Write([]byte(p))
+		result <- writeResult{n, err}
+	}()
+	return result
+}
+
+// Sets the send window of a stream added by addOwnedStream().
+func (t *ConnectionTest) setSendWindow(handle *StreamHandle, window int) {
+	t.conn.streams[handle.ID].SendFlowAvailable = window
+	handle.send.available = window
+}
+
+func (t *ConnectionTest) TestStreamWriteBlocksOnFlowControl(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.setSendWindow(handle, 6)
+	t.conn.config.MaxDataPayload = 4
+	t.start()
+
+	result := t.startWrite(handle, "0123456789")
+
+	// Writes are chunked by MaxDataPayload, and stall on the window.
+	c.Check(string(t.expectSent(c).(*DataFrame).Data), gc.Equals, "0123")
+	c.Check(string(t.expectSent(c).(*DataFrame).Data), gc.Equals, "45")
+	select {
+	case <-result:
+		c.Fatal("write didn't block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	t.recvMux <- &WindowUpdateFrame{
+		FramePrefix: FramePrefix{StreamID: 1}, SizeDelta: 10}
+	c.Check(string(t.expectSent(c).(*DataFrame).Data), gc.Equals, "6789")
+	c.Check(<-result, gc.Equals, writeResult{10, nil})
+}
+
+func (t *ConnectionTest) TestStreamCloseWrite(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	n, err := handle.Write([]byte("hello"))
+	c.Check(n, gc.Equals, 5)
+	c.Check(err, gc.IsNil)
+	c.Check(handle.CloseWrite(), gc.IsNil)
+	c.Check(handle.CloseWrite(), gc.IsNil)
+
+	c.Check(string(t.expectSent(c).(*DataFrame).Data), gc.Equals, "hello")
+	fin := t.expectSent(c).(*DataFrame)
+	c.Check(fin.Flags, gc.Equals, END_STREAM)
+	c.Check(fin.Data, gc.HasLen, 0)
+	c.Check(t.streamState(1), gc.Equals, HalfClosedLocal)
+
+	_, err = handle.Write([]byte("more"))
+	c.Check(err.(*Error).Code, gc.Equals, STREAM_CLOSED)
+
+	// The stream may still be read.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Data:        []byte("response"),
+	}
+	body, err := io.ReadAll(handle)
+	c.Check(err, gc.IsNil)
+	c.Check(string(body), gc.Equals, "response")
+}
+
+func (t *ConnectionTest) TestStreamClose(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 60),
+	}
+	c.Check(handle.Close(), gc.IsNil)
+	c.Check(t.expectSent(c).(*DataFrame).Flags, gc.Equals, END_STREAM)
+
+	// Unread DATA is discarded, and returned to the peer.
+	update := t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(1))
+	c.Check(update.SizeDelta, gc.Equals, uint32(60))
+
+	_, err := handle.Read(make([]byte, 10))
+	c.Check(err.(*Error).Code, gc.Equals, STREAM_CLOSED)
+
+	// As is DATA which follows.
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        make([]byte, 60),
+	}
+	update = t.expectSent(c).(*WindowUpdateFrame)
+	c.Check(update.StreamID, gc.Equals, StreamID(1))
+	c.Check(update.SizeDelta, gc.Equals, uint32(60))
+}
+
+func (t *ConnectionTest) TestStreamReset(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	c.Check(handle.Reset(CANCEL), gc.IsNil)
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, CANCEL)
+
+	_, err := handle.Read(make([]byte, 10))
+	c.Check(err.(*Error).Code, gc.Equals, CANCEL)
+	_, err = handle.Write([]byte("data"))
+	c.Check(err.(*Error).Code, gc.Equals, CANCEL)
+
+	t.syncLoop(c)
+	c.Check(t.streamState(1), gc.Equals, ClosedWithSentReset)
+}
+
+func (t *ConnectionTest) TestStreamResetIsIdempotent(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	peerReset := t.addOwnedStream(3, Open, 100)
+	t.start()
+
+	c.Check(handle.Reset(CANCEL), gc.IsNil)
+	c.Check(handle.Reset(INTERNAL_ERROR), gc.IsNil)
+	c.Check(t.expectSent(c).(*RstStreamFrame).Error.Code, gc.Equals, CANCEL)
+
+	// Nor is the stream reset once reset by the peer.
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 3},
+		Error:       Error{Code: CANCEL},
+	}
+	t.syncLoop(c)
+	c.Check(peerReset.Reset(CANCEL), gc.IsNil)
+
+	// The connection remains usable.
+	t.recvMux <- &PingFrame{}
+	c.Check(t.expectSent(c).(*PingFrame).Flags, gc.Equals, ACK)
+}
+
+func (t *ConnectionTest) TestRstStreamOfResetStreamIsDropped(c *gc.C) {
+	t.addStream(1, ClosedWithSentReset)
+	t.start()
+
+	t.handle.queueMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL},
+	}
+	t.recvMux <- &PingFrame{}
+	c.Check(t.expectSent(c).(*PingFrame).Flags, gc.Equals, ACK)
+	t.syncLoop(c)
+	c.Check(t.streamState(1), gc.Equals, ClosedWithSentReset)
+}
+
+func (t *ConnectionTest) TestPeerResetFailsBlockedWrite(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.setSendWindow(handle, 0)
+	t.start()
+
+	result := t.startWrite(handle, "stalled")
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: INTERNAL_ERROR},
+	}
+	written := <-result
+	c.Check(written.n, gc.Equals, 0)
+	c.Check(written.err.(*Error).Code, gc.Equals, INTERNAL_ERROR)
+	c.Check(written.err.(*Error).Level, gc.Equals, StreamError)
+}
+
+func (t *ConnectionTest) TestOpenedStreamIsReadWriteCloser(c *gc.C) {
+	t.setUp(false)
+	t.start()
+
+	var stream io.ReadWriteCloser
+	stream, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Assert(err, gc.IsNil)
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &HeadersFrame{})
+
+	_, werr := stream.Write([]byte("request"))
+	c.Check(werr, gc.IsNil)
+	c.Check(stream.Close(), gc.IsNil)
+	c.Check(string(t.expectSent(c).(*DataFrame).Data), gc.Equals, "request")
+	c.Check(t.expectSent(c).(*DataFrame).Flags, gc.Equals, END_STREAM)
+}
+
+func (t *ConnectionTest) TestReadSegment(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	for _, data := range []*DataFrame{
+		{Data: []byte("ab")},
+		{Data: []byte("cd"), FramePrefix: FramePrefix{Flags: END_SEGMENT}},
+		{FramePrefix: FramePrefix{Flags: END_SEGMENT}},
+		{Data: []byte("ef"),
+			FramePrefix: FramePrefix{Flags: END_SEGMENT | END_STREAM}},
+	} {
+		data.StreamID = 1
+		t.recvMux <- data
+	}
+	t.syncLoop(c)
+
+	type segmentRead struct {
+		data       string
+		endSegment bool
+	}
+	var reads []segmentRead
+	for {
+		p := make([]byte, 3)
+		n, endSegment, err := handle.ReadSegment(p)
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, gc.IsNil)
+		reads = append(reads, segmentRead{string(p[:n]), endSegment})
+	}
+	c.Check(reads, gc.DeepEquals, []segmentRead{
+		{"abc", false}, {"d", true}, {"", true}, {"ef", true}})
+}
+
+func (t *ConnectionTest) TestWriteSegment(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.setSendWindow(handle, 100)
+	t.handle.config.MaxDataPayload = 4
+	t.start()
+
+	n, err := handle.WriteSegment([]byte("hello"))
+	c.Check(n, gc.Equals, 5)
+	c.Check(err, gc.IsNil)
+	_, err = handle.WriteSegment(nil)
+	c.Check(err, gc.IsNil)
+
+	// Only the segment's final frame is marked.
+	for _, expected := range []DataFrame{
+		{Data: []byte("hell")},
+		{Data: []byte("o"), FramePrefix: FramePrefix{Flags: END_SEGMENT}},
+		{FramePrefix: FramePrefix{Flags: END_SEGMENT}},
+	} {
+		data := t.expectSent(c).(*DataFrame)
+		c.Check(string(data.Data), gc.Equals, string(expected.Data))
+		c.Check(data.Flags, gc.Equals, expected.Flags)
+	}
+}
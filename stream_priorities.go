@@ -0,0 +1,45 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+// Default number of streams for which a priority is retained.
+const kPriorityRetention = 128
+
+// Bounded record of stream priorities, as last set by the peer through
+// HEADERS or PRIORITY. The peer may prioritize idle and closed streams
+// (eg, as placeholders for dependents), so priorities are recorded
+// independently of Streams. Once capacity is reached, the stream least
+// recently prioritized is evicted and reverts to the default priority.
+type streamPriorities struct {
+	capacity int
+
+	priorities map[StreamID]FramePriority
+	order      []StreamID // Retained streams, least recently set first.
+}
+
+func (r *streamPriorities) set(id StreamID, priority FramePriority) {
+	if _, ok := r.priorities[id]; ok {
+		for i, other := range r.order {
+			if other == id {
+				r.order = append(r.order[:i], r.order[i+1:]...)
+				break
+			}
+		}
+	} else if r.capacity <= 0 {
+		return
+	} else if len(r.order) == r.capacity {
+		delete(r.priorities, r.order[0])
+		r.order = r.order[1:]
+	}
+	if r.priorities == nil {
+		r.priorities = make(map[StreamID]FramePriority)
+	}
+	r.priorities[id] = priority
+	r.order = append(r.order, id)
+}
+
+func (r *streamPriorities) lookup(id StreamID) (FramePriority, bool) {
+	priority, ok := r.priorities[id]
+	return priority, ok
+}
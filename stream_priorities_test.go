@@ -0,0 +1,226 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+
+	gc "gopkg.in/check.v1"
+)
+
+type StreamPrioritiesTest struct{}
+
+func (t *StreamPrioritiesTest) TestEvictsLeastRecentlySet(c *gc.C) {
+	record := streamPriorities{capacity: 2}
+
+	record.set(5, FramePriority{PriorityWeight: 1})
+	record.set(3, FramePriority{PriorityWeight: 2})
+	record.set(5, FramePriority{PriorityWeight: 3})
+	record.set(1, FramePriority{PriorityWeight: 4})
+
+	_, ok := record.lookup(3)
+	c.Check(ok, gc.Equals, false)
+	priority, ok := record.lookup(5)
+	c.Check(ok, gc.Equals, true)
+	c.Check(priority.PriorityWeight, gc.Equals, uint8(3))
+	c.Check(record.order, gc.DeepEquals, []StreamID{5, 1})
+}
+
+func (t *StreamPrioritiesTest) TestZeroCapacity(c *gc.C) {
+	record := streamPriorities{}
+
+	record.set(3, FramePriority{PriorityWeight: 1})
+	_, ok := record.lookup(3)
+	c.Check(ok, gc.Equals, false)
+}
+
+var _ = gc.Suite(&StreamPrioritiesTest{})
+
+func (t *ConnectionTest) TestPriorityOfIdleStream(c *gc.C) {
+	t.start()
+
+	t.recvMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 5, Flags: PRIORITY_GROUP},
+		FramePriority: FramePriority{PriorityGroup: 1, PriorityWeight: 16},
+	}
+	t.syncLoop(c)
+
+	// The stream is prioritized, but remains idle.
+	priority, ok := t.conn.writeQueue.priorities.lookup(5)
+	c.Check(ok, gc.Equals, true)
+	c.Check(priority.PriorityWeight, gc.Equals, uint8(16))
+	c.Check(t.conn.streams, gc.HasLen, 0)
+	c.Check(t.conn.lastRemoteID, gc.Equals, StreamID(0))
+
+	// Lower streams may still be opened by the peer.
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 3, Flags: PRIORITY_DEPENDENCY},
+		FramePriority: FramePriority{
+			ExclusiveDependency: true, StreamDependency: 5},
+	}
+	t.syncLoop(c)
+	c.Check(t.streamState(3), gc.Equals, Open)
+
+	priority, _ = t.conn.writeQueue.priorities.lookup(3)
+	c.Check(priority.StreamDependency, gc.Equals, StreamID(5))
+}
+
+func (t *ConnectionTest) TestPriorityOfClosedStream(c *gc.C) {
+	t.addStream(1, Closed)
+	t.addStream(3, ClosedWithSentReset)
+	t.start()
+
+	for _, id := range []StreamID{1, 3} {
+		t.recvMux <- &PriorityFrame{
+			FramePrefix:   FramePrefix{StreamID: id, Flags: PRIORITY_DEPENDENCY},
+			FramePriority: FramePriority{StreamDependency: 7},
+		}
+	}
+	t.syncLoop(c)
+
+	// States are unchanged, and no RST_STREAM was sent.
+	c.Check(t.streamState(1), gc.Equals, Closed)
+	c.Check(t.streamState(3), gc.Equals, ClosedWithSentReset)
+	_, ok := t.conn.writeQueue.priorities.lookup(3)
+	c.Check(ok, gc.Equals, true)
+}
+
+func (t *ConnectionTest) TestPriorityAfterGoAway(c *gc.C) {
+	t.addStream(1, Open)
+	t.start()
+	t.shutdown(context.Background())
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &GoAwayFrame{})
+
+	// Unlike HEADERS, PRIORITY of a later peer stream isn't refused.
+	t.recvMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 7, Flags: PRIORITY_GROUP},
+		FramePriority: FramePriority{PriorityGroup: 1, PriorityWeight: 1},
+	}
+	t.syncLoop(c)
+	_, ok := t.conn.writeQueue.priorities.lookup(7)
+	c.Check(ok, gc.Equals, true)
+	c.Check(t.conn.streams, gc.HasLen, 1)
+}
+
+func (t *ConnectionTest) TestPriorityOfStreamZero(c *gc.C) {
+	t.start()
+
+	t.recvMux <- &PriorityFrame{FramePrefix: FramePrefix{Flags: PRIORITY_GROUP}}
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+	t.expectClosed(c)
+}
+
+func (t *ConnectionTest) TestPrioritySelfDependency(c *gc.C) {
+	t.addStream(1, Open)
+	t.start()
+
+	// An open stream is reset.
+	t.recvMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 1, Flags: PRIORITY_DEPENDENCY},
+		FramePriority: FramePriority{StreamDependency: 1},
+	}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, PROTOCOL_ERROR)
+
+	// An idle stream can't be, and the frame is ignored.
+	t.recvMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 3, Flags: PRIORITY_DEPENDENCY},
+		FramePriority: FramePriority{StreamDependency: 3},
+	}
+	t.syncLoop(c)
+	_, ok := t.conn.writeQueue.priorities.lookup(3)
+	c.Check(ok, gc.Equals, false)
+	c.Check(t.conn.streams, gc.HasLen, 0)
+}
+
+func (t *ConnectionTest) TestSendPriority(c *gc.C) {
+	t.start()
+
+	t.handle.queueMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 3, Flags: PRIORITY_GROUP},
+		FramePriority: FramePriority{PriorityGroup: 1, PriorityWeight: 1},
+	}
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PriorityFrame{})
+}
+
+// Queues DATA of the streams in turn, and returns the streams of DATA
+// as it's written. The first frame is written ahead of the rest.
+func (t *ConnectionTest) queueAndSendData(c *gc.C,
+	streams ...StreamID) (sent []StreamID) {
+
+	for _, id := range streams {
+		t.handle.queueMux <- &DataFrame{
+			FramePrefix: FramePrefix{StreamID: id},
+			Data:        []byte("0123456789"),
+		}
+	}
+	for range streams {
+		sent = append(sent, t.expectSent(c).GetStreamID())
+	}
+	return sent
+}
+
+func (t *ConnectionTest) TestDataScheduledByWeight(c *gc.C) {
+	t.conn.sendFlowAvailable = 1000
+	for _, id := range []StreamID{1, 3} {
+		t.addStream(id, Open)
+		t.conn.streams[id].SendFlowAvailable = 100
+	}
+	t.start()
+
+	// Stream 1 has the least weight. Stream 3 has the default.
+	t.recvMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 1, Flags: PRIORITY_GROUP},
+		FramePriority: FramePriority{PriorityGroup: 1, PriorityWeight: 0},
+	}
+	c.Check(t.queueAndSendData(c, 1, 1, 1, 3, 3, 3), gc.DeepEquals,
+		[]StreamID{1, 3, 3, 3, 1, 1})
+}
+
+func (t *ConnectionTest) TestDataDoesNotOvertakeControlFrames(c *gc.C) {
+	t.conn.sendFlowAvailable = 1000
+	for _, id := range []StreamID{1, 3} {
+		t.addStream(id, Open)
+		t.conn.streams[id].SendFlowAvailable = 100
+	}
+	t.start()
+
+	// Stream 1 has the least weight. Stream 3 has the default.
+	t.recvMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 1, Flags: PRIORITY_GROUP},
+		FramePriority: FramePriority{PriorityGroup: 1, PriorityWeight: 0},
+	}
+	for _, frame := range []Frame{
+		&DataFrame{FramePrefix: FramePrefix{StreamID: 1}, Data: []byte("a")},
+		&DataFrame{FramePrefix: FramePrefix{StreamID: 1}, Data: []byte("b")},
+		&PingFrame{},
+		&DataFrame{FramePrefix: FramePrefix{StreamID: 3}, Data: []byte("c")},
+	} {
+		t.handle.queueMux <- frame
+	}
+	// Stream 3 is preferred, but its DATA was queued after the PING.
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.DeepEquals, []byte("a"))
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.DeepEquals, []byte("b"))
+	c.Check(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+	c.Check(t.expectSent(c).(*DataFrame).Data, gc.DeepEquals, []byte("c"))
+}
+
+func (t *ConnectionTest) TestDataScheduledByDependency(c *gc.C) {
+	t.conn.sendFlowAvailable = 1000
+	for _, id := range []StreamID{1, 3, 5} {
+		t.addStream(id, Open)
+		t.conn.streams[id].SendFlowAvailable = 100
+	}
+	t.start()
+
+	// Stream 3 depends on stream 1. Stream 5 is independent.
+	t.recvMux <- &PriorityFrame{
+		FramePrefix:   FramePrefix{StreamID: 3, Flags: PRIORITY_DEPENDENCY},
+		FramePriority: FramePriority{StreamDependency: 1},
+	}
+	c.Check(t.queueAndSendData(c, 5, 3, 3, 1, 1), gc.DeepEquals,
+		[]StreamID{5, 1, 1, 3, 3})
+}
@@ -8,7 +8,6 @@ import (
 )
 
 type StreamTest struct {
-	pump   chan int
 	stream *Stream
 }
 
@@ -18,9 +17,9 @@ type errCase struct {
 }
 
 type successCase struct {
-	state      StreamState
-	pumpOpened bool
-	pumpClosed bool
+	state        StreamState
+	windowOpened bool
+	closed       bool
 }
 
 type transitionCases struct {
@@ -56,19 +55,18 @@ func defaultTransitionOutcomes() transitionCases {
 }
 
 func verifyTransitions(model Stream, outcomes transitionCases, c *gc.C) {
-	var pump chan int
 	var underTest *Stream
 
 	from := func() *Stream {
-		pump = make(chan int, 1)
 		underTest = &Stream{
 			ID:                model.ID,
 			State:             model.State,
 			SendFlowAvailable: 4096,
-			SendFlowPump:      pump,
+			events:            newStreamEvents(),
 		}
 		return underTest
 	}
+	resetErr := &Error{Code: CANCEL, Level: StreamError}
 
 	verify := func(outcome interface{}, err *Error) {
 		if expected, ok := outcome.(*errCase); ok {
@@ -80,20 +78,26 @@ func verifyTransitions(model Stream, outcomes transitionCases, c *gc.C) {
 		expected := outcome.(*successCase)
 		c.Check(underTest.State, gc.Equals, expected.state)
 
-		select {
-		case r, ok := <-pump:
-			if expected.pumpOpened {
-				c.Check(ok, gc.Equals, true)
-				c.Check(r, gc.Equals, underTest.SendFlowAvailable)
-			} else if expected.pumpClosed {
-				c.Check(ok, gc.Equals, false)
-			} else {
-				c.Error("unexpected pump update: ", r, ok)
+		events := underTest.events.pending
+		windowOpened, closed := false, false
+		for i, event := range events {
+			switch e := event.(type) {
+			case *WindowEvent:
+				c.Check(i, gc.Equals, 0)
+				c.Check(e.Delta, gc.Equals, underTest.SendFlowAvailable)
+				c.Check(e.Available, gc.Equals, underTest.SendFlowAvailable)
+				windowOpened = true
+			case *ResetEvent:
+				c.Check(e.Err, gc.Equals, resetErr)
+			case *ClosedEvent:
+				c.Check(i, gc.Equals, len(events)-1)
+				closed = true
+			default:
+				c.Error("unexpected event: ", event)
 			}
-		default:
-			c.Check(expected.pumpOpened, gc.Equals, false)
-			c.Check(expected.pumpClosed, gc.Equals, false)
 		}
+		c.Check(windowOpened, gc.Equals, expected.windowOpened)
+		c.Check(closed, gc.Equals, expected.closed)
 		if c.Failed() {
 			panic(false) // Generate a callstack.
 		}
@@ -104,13 +108,13 @@ func verifyTransitions(model Stream, outcomes transitionCases, c *gc.C) {
 	verify(outcomes.onRecvHeaders, from().onHeaders(Receive, false))
 	verify(outcomes.onRecvHeadersWithFin, from().onHeaders(Receive, true))
 	verify(outcomes.onRecvPushPromise, from().onPushPromise(Receive))
-	verify(outcomes.onRecvReset, from().onReset(Receive))
+	verify(outcomes.onRecvReset, from().onReset(Receive, resetErr))
 	verify(outcomes.onSendData, from().onData(Send, false))
 	verify(outcomes.onSendDataWithFin, from().onData(Send, true))
 	verify(outcomes.onSendHeaders, from().onHeaders(Send, false))
 	verify(outcomes.onSendHeadersWithFin, from().onHeaders(Send, true))
 	verify(outcomes.onSendPushPromise, from().onPushPromise(Send))
-	verify(outcomes.onSendReset, from().onReset(Send))
+	verify(outcomes.onSendReset, from().onReset(Send, resetErr))
 }
 
 func (t *StreamTest) TestTransitionsFromIdle(c *gc.C) {
@@ -118,10 +122,10 @@ func (t *StreamTest) TestTransitionsFromIdle(c *gc.C) {
 
 	cases.onRecvHeaders = &successCase{Open, true, false}
 	cases.onRecvHeadersWithFin = &successCase{HalfClosedRemote, true, false}
-	cases.onRecvPushPromise = &successCase{ReservedRemote, false, true}
+	cases.onRecvPushPromise = &successCase{ReservedRemote, false, false}
 	cases.onRecvReset = &errCase{ConnectionError, PROTOCOL_ERROR}
 	cases.onSendHeaders = &successCase{Open, true, false}
-	cases.onSendHeadersWithFin = &successCase{HalfClosedLocal, false, true}
+	cases.onSendHeadersWithFin = &successCase{HalfClosedLocal, false, false}
 	cases.onSendPushPromise = &successCase{ReservedLocal, false, false}
 	cases.onSendReset = &errCase{ConnectionError, INTERNAL_ERROR}
 
@@ -141,9 +145,7 @@ func (t *StreamTest) TestTransitionsFromReservedRemote(c *gc.C) {
 	cases := defaultTransitionOutcomes()
 
 	cases.onRecvHeaders = &successCase{HalfClosedLocal, false, false}
-	cases.onRecvHeadersWithFin = &successCase{Closed, false, false}
-	cases.onRecvReset = &successCase{Closed, false, false}
-	cases.onSendReset = &successCase{ClosedWithSentReset, false, false}
+	cases.onRecvHeadersWithFin = &successCase{Closed, false, true}
 
 	verifyTransitions(Stream{State: ReservedRemote}, cases, c)
 }
@@ -156,9 +158,9 @@ func (t *StreamTest) TestTransitionsFromOpen(c *gc.C) {
 	cases.onRecvHeaders = &successCase{Open, false, false}
 	cases.onRecvHeadersWithFin = &successCase{HalfClosedRemote, false, false}
 	cases.onSendData = &successCase{Open, false, false}
-	cases.onSendDataWithFin = &successCase{HalfClosedLocal, false, true}
+	cases.onSendDataWithFin = &successCase{HalfClosedLocal, false, false}
 	cases.onSendHeaders = &successCase{Open, false, false}
-	cases.onSendHeadersWithFin = &successCase{HalfClosedLocal, false, true}
+	cases.onSendHeadersWithFin = &successCase{HalfClosedLocal, false, false}
 
 	verifyTransitions(Stream{State: Open}, cases, c)
 }
@@ -178,11 +180,9 @@ func (t *StreamTest) TestTransitionsFromHalfClosedLocal(c *gc.C) {
 	cases := defaultTransitionOutcomes()
 
 	cases.onRecvData = &successCase{HalfClosedLocal, false, false}
-	cases.onRecvDataWithFin = &successCase{Closed, false, false}
+	cases.onRecvDataWithFin = &successCase{Closed, false, true}
 	cases.onRecvHeaders = &successCase{HalfClosedLocal, false, false}
-	cases.onRecvHeadersWithFin = &successCase{Closed, false, false}
-	cases.onRecvReset = &successCase{Closed, false, false}
-	cases.onSendReset = &successCase{ClosedWithSentReset, false, false}
+	cases.onRecvHeadersWithFin = &successCase{Closed, false, true}
 
 	verifyTransitions(Stream{State: HalfClosedLocal}, cases, c)
 }
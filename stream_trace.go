@@ -0,0 +1,81 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A change of a stream's state, caused by the Frame being sent or
+// recieved. Implicit transitions, of streams which are abandoned or
+// implicitly closed, have no frame.
+type StreamTransition struct {
+	From, To StreamState
+	Frame    FrameType
+	Dir      SendOrReceive
+	Implicit bool
+}
+
+func (t StreamTransition) String() string {
+	cause := "implicit"
+	if !t.Implicit && t.Dir == Send {
+		cause = "sent " + t.Frame.String()
+	} else if !t.Implicit {
+		cause = "recieved " + t.Frame.String()
+	}
+	return fmt.Sprintf("%v -> %v (%v)", t.From, t.To, cause)
+}
+
+// Transitions the stream on a frame of the type.
+func (s *Stream) setState(to StreamState, frame FrameType, dir SendOrReceive) {
+	s.recordTransition(StreamTransition{
+		From: s.State, To: to, Frame: frame, Dir: dir})
+}
+
+// Transitions the stream without a frame.
+func (s *Stream) setStateImplicitly(to StreamState) {
+	s.recordTransition(StreamTransition{From: s.State, To: to, Implicit: true})
+}
+
+func (s *Stream) recordTransition(transition StreamTransition) {
+	s.State = transition.To
+	if s.counts != nil {
+		s.counts.onTransition(s.ID, transition.From, transition.To)
+	}
+	if s.tracer != nil && transition.From != transition.To {
+		s.transitions = append(s.transitions, transition)
+		s.tracer.OnEvent(StreamTransitionEvent{s.ID, transition})
+	}
+}
+
+// Reports a violated invariant of the stream's state machine, which is
+// a bug of this package. The stream is reset with INTERNAL_ERROR, or
+// if Config.PanicOnStreamInvariant, the violation panics.
+func (s *Stream) invariantViolated(format string, args ...interface{}) *Error {
+	err := internalError("stream %v invariant violated: %v",
+		s.ID, fmt.Sprintf(format, args...))
+	err.Level = StreamError
+
+	if len(s.transitions) != 0 {
+		var trace []string
+		for _, transition := range s.transitions {
+			trace = append(trace, transition.String())
+		}
+		err.Err = fmt.Errorf("%v (after %v)", err.Err,
+			strings.Join(trace, ", "))
+	}
+	if s.panicOnInvariant {
+		panic(err)
+	}
+	return err
+}
+
+// Applies the Config's tracing and invariant checking to the stream.
+func (c *connection) instrumentStream(stream *Stream) {
+	stream.panicOnInvariant = c.config.PanicOnStreamInvariant
+	if c.config.TraceStreams {
+		stream.tracer = c.config.Events
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (t *StreamTest) TestFinInvariants(c *gc.C) {
+	stream := &Stream{ID: 1, State: Closed, events: newStreamEvents()}
+
+	for _, err := range []*Error{
+		stream.onRemoteFin(DATA),
+		stream.onLocalFin(HEADERS),
+	} {
+		c.Check(err.Code, gc.Equals, INTERNAL_ERROR)
+		c.Check(err.Level, gc.Equals, StreamError)
+	}
+	c.Check(stream.State, gc.Equals, Closed)
+
+	stream.panicOnInvariant = true
+	c.Check(func() { stream.onRemoteFin(DATA) }, gc.PanicMatches,
+		"stream 1 invariant violated: recieved END_STREAM of DATA "+
+			"in state Closed")
+}
+
+func (t *StreamTest) TestTracedTransitions(c *gc.C) {
+	var traced []Event
+	stream := &Stream{ID: 1, State: Idle, events: newStreamEvents(),
+		tracer: EventHookFunc(func(event Event) {
+			traced = append(traced, event)
+		})}
+
+	c.Check(stream.onHeaders(Send, false), gc.IsNil)
+	c.Check(stream.onData(Send, false), gc.IsNil) // Not a transition.
+	c.Check(stream.onData(Send, true), gc.IsNil)
+	c.Check(stream.onRemoteFin(DATA), gc.IsNil)
+
+	c.Check(traced, gc.DeepEquals, []Event{
+		StreamTransitionEvent{1, StreamTransition{
+			From: Idle, To: Open, Frame: HEADERS, Dir: Send}},
+		StreamTransitionEvent{1, StreamTransition{
+			From: Open, To: HalfClosedLocal, Frame: DATA, Dir: Send}},
+		StreamTransitionEvent{1, StreamTransition{
+			From: HalfClosedLocal, To: Closed, Frame: DATA, Dir: Receive}},
+	})
+
+	// Violations include the stream's transitions.
+	c.Check(stream.onLocalFin(DATA), gc.ErrorMatches,
+		"stream 1 invariant violated: sent END_STREAM of DATA in state "+
+			"Closed \\(after Idle -> Open \\(sent HEADERS\\), "+
+			"Open -> HalfClosedLocal \\(sent DATA\\), "+
+			"HalfClosedLocal -> Closed \\(recieved DATA\\)\\)")
+}
+
+func (t *ConnectionTest) TestTraceStreams(c *gc.C) {
+	t.setUp(false)
+	var traced []string
+	t.conn.config.TraceStreams = true
+	t.conn.config.Events = EventHookFunc(func(event Event) {
+		if _, ok := event.(StreamTransitionEvent); ok {
+			traced = append(traced, event.String())
+		}
+	})
+	t.start()
+
+	stream, err := t.handle.OpenStream(context.Background(), &HeadersFrame{})
+	c.Assert(err, gc.IsNil)
+	t.expectSent(c)
+
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: stream.ID, Flags: END_STREAM}}
+	t.handle.queueMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: stream.ID},
+		Error:       Error{Code: CANCEL},
+	}
+	t.expectSent(c)
+
+	c.Check(traced, gc.DeepEquals, []string{
+		"stream 1 Idle -> Open (sent HEADERS)",
+		"stream 1 Open -> HalfClosedRemote (recieved DATA)",
+		"stream 1 HalfClosedRemote -> ClosedWithSentReset (sent RST_STREAM)",
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Timeouts after which a connection is gracefully shut down with GOAWAY.
+// A zero duration disables the timeout.
+type Timeouts struct {
+	// Time allowed for the peer's initial SETTINGS, which completes its
+	// connection preface. Expiry closes the connection with a
+	// PROTOCOL_ERROR GOAWAY, as the peer failed to send a valid preface,
+	// and Err() reports the timeout. (SETTINGS_TIMEOUT is reserved for
+	// SETTINGS which are sent but not acknowledged.)
+	Handshake time.Duration
+	// Time allowed without active streams.
+	Idle time.Duration
+	// Maximum time for which the connection accepts new streams.
+	MaxAge time.Duration
+}
+
+// Source of time for connection timeouts. Replaced by tests.
+type clock interface {
+	Now() time.Time
+	// Returns a channel which recieves once d has elapsed,
+	// and a function which stops the timer.
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// Tracks connection deadlines, and the single timer armed for the
+// earliest of them.
+type deadlines struct {
+	started   time.Time
+	idleSince time.Time // Zero while streams are active.
+
+	armed     time.Time
+	timer     <-chan time.Time
+	stopTimer func() bool
+}
+
+// Updates idle tracking, and re-arms the timer to the earliest deadline
+// which remains applicable. Called on each iteration of mainLoop().
+func (c *connection) armTimeouts() {
+	d := &c.deadlines
+
+	if c.counts.active != 0 || len(c.pendingOpens) != 0 {
+		d.idleSince = time.Time{}
+	} else if d.idleSince.IsZero() {
+		d.idleSince = c.clock.Now()
+	}
+
+	next := c.nextDeadline()
+	if next.Equal(d.armed) {
+		return
+	}
+	c.disarmTimeouts()
+	if !next.IsZero() {
+		d.armed = next
+		d.timer, d.stopTimer = c.clock.NewTimer(next.Sub(c.clock.Now()))
+	}
+}
+
+func (c *connection) disarmTimeouts() {
+	d := &c.deadlines
+	if d.stopTimer != nil {
+		d.stopTimer()
+	}
+	d.armed, d.timer, d.stopTimer = time.Time{}, nil, nil
+}
+
+// Earliest applicable deadline, or zero if there is none. Deadlines
+// no longer apply once shutdown has begun.
+func (c *connection) nextDeadline() time.Time {
+	var next time.Time
+	if c.goAwaySent || c.shutdownPing != nil {
+		return next
+	}
+	consider := func(from time.Time, timeout time.Duration) {
+		if from.IsZero() || timeout == 0 {
+			return
+		}
+		if at := from.Add(timeout); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	d := &c.deadlines
+	if !c.settingsRecieved {
+		consider(d.started, c.config.Timeouts.Handshake)
+	}
+	consider(d.idleSince, c.config.Timeouts.Idle)
+	consider(d.started, c.config.Timeouts.MaxAge)
+	return next
+}
+
+// Begins shutdown for each deadline which has passed.
+func (c *connection) onTimeout() {
+	now, d := c.clock.Now(), &c.deadlines
+	c.disarmTimeouts()
+
+	expired := func(from time.Time, timeout time.Duration) bool {
+		return !from.IsZero() && timeout != 0 &&
+			!now.Before(from.Add(timeout))
+	}
+	if !c.settingsRecieved &&
+		expired(d.started, c.config.Timeouts.Handshake) {
+		c.handleError(&Error{Code: PROTOCOL_ERROR, Level: ConnectionError,
+			Err: fmt.Errorf("no SETTINGS recieved within %v: %w",
+				c.config.Timeouts.Handshake, os.ErrDeadlineExceeded)}, nil)
+	} else if expired(d.idleSince, c.config.Timeouts.Idle) ||
+		expired(d.started, c.config.Timeouts.MaxAge) {
+		c.beginShutdown()
+	}
+}
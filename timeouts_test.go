@@ -0,0 +1,161 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+// Clock which advances only when told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Unix(1400000000, 0),
+		timers: make(map[*fakeTimer]bool),
+	}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	timer := &fakeTimer{at: f.now.Add(d), c: make(chan time.Time, 1)}
+	f.timers[timer] = true
+	f.fire()
+
+	return timer.c, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		pending := f.timers[timer]
+		delete(f.timers, timer)
+		return pending
+	}
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	f.fire()
+}
+
+func (f *fakeClock) fire() {
+	for timer := range f.timers {
+		if !f.now.Before(timer.at) {
+			timer.c <- f.now
+			delete(f.timers, timer)
+		}
+	}
+}
+
+// Round-trips a PING through mainLoop(), which will then have armed
+// timers for the connection's current state.
+func (t *ConnectionTest) syncLoop(c *gc.C) {
+	t.handle.queueMux <- &PingFrame{}
+	c.Assert(t.expectSent(c), gc.FitsTypeOf, &PingFrame{})
+}
+
+func (t *ConnectionTest) TestHandshakeTimeout(c *gc.C) {
+	clock := newFakeClock()
+	t.conn.clock = clock
+	t.conn.config.Timeouts.Handshake = 5 * time.Second
+	t.start()
+
+	t.syncLoop(c)
+	clock.Advance(4 * time.Second)
+	t.syncLoop(c)
+	clock.Advance(time.Second)
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, PROTOCOL_ERROR)
+	t.expectClosed(c)
+
+	c.Check(t.handle.Err().Code, gc.Equals, PROTOCOL_ERROR)
+	c.Check(errors.Is(t.handle.Err(), os.ErrDeadlineExceeded),
+		gc.Equals, true)
+}
+
+func (t *ConnectionTest) TestHandshakeCompletes(c *gc.C) {
+	clock := newFakeClock()
+	t.conn.clock = clock
+	t.conn.config.Timeouts.Handshake = 5 * time.Second
+	t.start()
+
+	t.recvMux <- &SettingsFrame{}
+	c.Check(t.expectSent(c).(*SettingsFrame).Flags, gc.Equals, ACK)
+
+	clock.Advance(time.Minute)
+	t.syncLoop(c)
+}
+
+func (t *ConnectionTest) TestIdleTimeout(c *gc.C) {
+	clock := newFakeClock()
+	t.conn.clock = clock
+	t.conn.config.Timeouts.Idle = 5 * time.Second
+	t.addStream(1, Open)
+	t.start()
+
+	// Not idle while a stream is open.
+	t.syncLoop(c)
+	clock.Advance(time.Minute)
+	t.syncLoop(c)
+
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL},
+	}
+	t.syncLoop(c)
+	clock.Advance(4 * time.Second)
+	t.syncLoop(c)
+	clock.Advance(time.Second)
+
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, NO_ERROR)
+	t.expectClosed(c)
+}
+
+func (t *ConnectionTest) TestMaxConnectionAge(c *gc.C) {
+	clock := newFakeClock()
+	t.conn.clock = clock
+	t.conn.config.Timeouts.MaxAge = time.Hour
+	t.addStream(1, Open)
+	t.start()
+
+	t.syncLoop(c)
+	clock.Advance(time.Hour)
+
+	// Open streams are allowed to complete.
+	goAway := t.expectSent(c).(*GoAwayFrame)
+	c.Check(goAway.Error.Code, gc.Equals, NO_ERROR)
+	t.syncLoop(c)
+
+	t.recvMux <- &RstStreamFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Error:       Error{Code: CANCEL},
+	}
+	t.expectClosed(c)
+}
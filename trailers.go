@@ -0,0 +1,60 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"strings"
+)
+
+// Declares, through a "trailer" field of the stream's initial headers,
+// the names of trailers which will be sent with WriteTrailers().
+func DeclareTrailers(headers *HeadersFrame, names ...string) {
+	headers.Fields = append(headers.Fields, HeaderField{
+		Name:   "trailer",
+		Values: strings.Join(names, ","),
+	})
+}
+
+// Trailers are a header block which follows DATA and ends the stream.
+// They may not carry pseudo-header fields.
+func validateTrailers(fields []HeaderField) *Error {
+	for _, field := range fields {
+		if strings.HasPrefix(field.Name, ":") {
+			return protocolError("pseudo-header %v in trailers", field.Name)
+		}
+	}
+	return nil
+}
+
+// Ends the stream with trailers, queuing HEADERS with END_STREAM to
+// follow DATA already written. Subsequent writes fail.
+func (h *StreamHandle) WriteTrailers(fields []HeaderField) error {
+	if err := validateTrailers(fields); err != nil {
+		err.Code = INTERNAL_ERROR
+		err.Level = RecoverableError
+		return err
+	}
+	if err := h.checkHeadersSent(); err != nil {
+		return err
+	}
+	if closing, err := h.send.close(); err != nil {
+		return err
+	} else if !closing {
+		return &Error{Code: STREAM_CLOSED, Level: RecoverableError,
+			Err: kStreamWriteClosedError}
+	}
+	if err := h.conn.queue(&HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: h.ID, Flags: END_STREAM},
+		Fields:      fields,
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Returns trailers recieved from the peer. Trailers are available once
+// Read() has returned io.EOF, and are nil if the peer sent none.
+func (h *StreamHandle) Trailers() []HeaderField {
+	return h.recv.recievedTrailers()
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+package http2
+
+import (
+	"context"
+	"io"
+
+	gc "gopkg.in/check.v1"
+)
+
+func (t *ConnectionTest) TestRecieveTrailers(c *gc.C) {
+	handle := t.addOwnedStream(1, Open, 100)
+	t.start()
+
+	trailers := []HeaderField{{Name: "grpc-status", Values: "0"}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &DataFrame{
+		FramePrefix: FramePrefix{StreamID: 1},
+		Data:        []byte("body"),
+	}
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Fields:      trailers,
+	}
+	t.syncLoop(c)
+	c.Check(t.streamState(1), gc.Equals, HalfClosedRemote)
+
+	// Trailers are available only once the body is read.
+	c.Check(handle.Trailers(), gc.IsNil)
+	body, err := io.ReadAll(handle)
+	c.Check(err, gc.IsNil)
+	c.Check(string(body), gc.Equals, "body")
+	c.Check(handle.Trailers(), gc.DeepEquals, trailers)
+}
+
+func (t *ConnectionTest) TestTrailersMustEndStream(c *gc.C) {
+	t.addStream(1, Open)
+	t.start()
+
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.StreamID, gc.Equals, StreamID(1))
+	c.Check(rst.Error.Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestTrailersMayNotHavePseudoHeaders(c *gc.C) {
+	t.addStream(1, Open)
+	t.start()
+
+	t.recvMux <- &HeadersFrame{FramePrefix: FramePrefix{StreamID: 1}}
+	t.recvMux <- &HeadersFrame{
+		FramePrefix: FramePrefix{StreamID: 1, Flags: END_STREAM},
+		Fields:      []HeaderField{{Name: ":status", Values: "200"}},
+	}
+	rst := t.expectSent(c).(*RstStreamFrame)
+	c.Check(rst.Error.Code, gc.Equals, PROTOCOL_ERROR)
+}
+
+func (t *ConnectionTest) TestWriteTrailers(c *gc.C) {
+	t.setUp(false)
+	t.start()
+
+	headers := &HeadersFrame{}
+	DeclareTrailers(headers, "grpc-status", "grpc-message")
+	stream, err := t.handle.OpenStream(context.Background(), headers)
+	c.Assert(err, gc.IsNil)
+	c.Check(t.expectSent(c).(*HeadersFrame).Fields, gc.DeepEquals,
+		[]HeaderField{{Name: "trailer", Values: "grpc-status,grpc-message"}})
+
+	_, werr := stream.Write([]byte("body"))
+	c.Check(werr, gc.IsNil)
+
+	invalid := []HeaderField{{Name: ":status", Values: "200"}}
+	c.Check(stream.WriteTrailers(invalid), gc.ErrorMatches,
+		"pseudo-header :status in trailers")
+
+	trailers := []HeaderField{{Name: "grpc-status", Values: "0"}}
+	c.Check(stream.WriteTrailers(trailers), gc.IsNil)
+
+	c.Check(string(t.expectSent(c).(*DataFrame).Data), gc.Equals, "body")
+	sent := t.expectSent(c).(*HeadersFrame)
+	c.Check(sent.Flags, gc.Equals, END_STREAM)
+	c.Check(sent.Fields, gc.DeepEquals, trailers)
+	c.Check(t.streamState(1), gc.Equals, HalfClosedLocal)
+
+	// The stream has ended.
+	_, werr = stream.Write([]byte("more"))
+	c.Check(werr.(*Error).Code, gc.Equals, STREAM_CLOSED)
+	c.Check(stream.WriteTrailers(trailers).(*Error).Code, gc.Equals,
+		STREAM_CLOSED)
+}
@@ -5,6 +5,7 @@ package http2
 
 import (
 	"container/heap"
+	"math"
 )
 
 type queuedFrame struct {
@@ -13,12 +14,33 @@ type queuedFrame struct {
 }
 type queuedFrameHeap []queuedFrame
 
-// TODO: Use priorities. Prioritize control frames, etc. Fair scheduling.
+// Frames are written in queued order, except that DATA which is ready to
+// be written is scheduled across streams by the peer's priorities.
 type writeQueue struct {
 	frames      queuedFrameHeap
 	queuedCount int64
+
+	// Streams stalled on flow control. DATA and HEADERS of a stalled
+	// stream are parked, in queued order, until the stream is unstalled.
+	// While the connection is stalled, all DATA (and the DATA and HEADERS
+	// which follow it) are parked.
+	stalledStreams    map[StreamID]bool
+	connectionStalled bool
+	parked            map[StreamID][]queuedFrame
+
+	// Priorities of streams, as set by the peer. A stream's DATA yields
+	// to DATA of streams it depends on, and streams otherwise share the
+	// connection in proportion to their weight. Each stream is tagged
+	// with the virtual time at which its next DATA is due, which advances
+	// by bytes written over weight.
+	priorities  streamPriorities
+	virtualTime int64
+	tags        map[StreamID]int64
 }
 
+// Default weight of streams which haven't been prioritized.
+const kDefaultPriorityWeight = 16
+
 func (q *writeQueue) enqueueBack(frame Frame) {
 	heap.Push(&q.frames, queuedFrame{frame, q.queuedCount})
 	q.queuedCount += 1
@@ -30,14 +52,227 @@ func (q *writeQueue) enqueueFront(frame Frame) {
 }
 
 func (q *writeQueue) deque() (Frame, bool) {
-	if len(q.frames) > 0 {
-		result := q.frames[0].frame
-		heap.Remove(&q.frames, 0)
-		return result, true
+	for len(q.frames) > 0 {
+		next := heap.Pop(&q.frames).(queuedFrame)
+		if id := next.frame.GetStreamID(); q.mustPark(next.frame) {
+			if q.parked == nil {
+				q.parked = make(map[StreamID][]queuedFrame)
+			}
+			q.parked[id] = append(q.parked[id], next)
+			continue
+		}
+		if _, ok := next.frame.(*DataFrame); ok {
+			next = q.scheduleData(next)
+		}
+		return next.frame, true
 	}
 	return nil, false
 }
 
+// Chooses between head, the next DATA to write, and the first queued
+// frame of each other stream which is ready DATA. Only DATA queued
+// ahead of every other frame is considered: control frames are written
+// in queued order, and are never overtaken. The chosen frame is removed
+// from the queue, and head returned to it if not chosen.
+func (q *writeQueue) scheduleData(head queuedFrame) queuedFrame {
+	firstOf := make(map[StreamID]int)
+	firstControl := int64(math.MaxInt64)
+	for i, queued := range q.frames {
+		id := queued.frame.GetStreamID()
+		if j, ok := firstOf[id]; !ok ||
+			queued.priority < q.frames[j].priority {
+			firstOf[id] = i
+		}
+		if _, ok := queued.frame.(*DataFrame); !ok &&
+			queued.priority < firstControl {
+			firstControl = queued.priority
+		}
+	}
+	ready := map[StreamID]int{head.frame.GetStreamID(): -1}
+	for id, i := range firstOf {
+		if id == head.frame.GetStreamID() {
+			continue // Head is the stream's first frame.
+		} else if q.frames[i].priority > firstControl {
+			continue // Queued behind a control frame.
+		} else if _, ok := q.frames[i].frame.(*DataFrame); ok &&
+			!q.mustPark(q.frames[i].frame) {
+			ready[id] = i
+		}
+	}
+	if len(ready) == 1 {
+		return head
+	}
+	// Streams depending on another ready stream yield to it. Of the
+	// rest, the stream due earliest is chosen, then the first queued.
+	var best *queuedFrame
+	bestIndex := -1
+	for id, i := range ready {
+		if q.dependsOnAny(id, ready) {
+			continue
+		}
+		candidate := &head
+		if i != -1 {
+			candidate = &q.frames[i]
+		}
+		if best == nil {
+			best, bestIndex = candidate, i
+		} else if tag, bestTag := q.tag(id),
+			q.tag(best.frame.GetStreamID()); tag < bestTag ||
+			(tag == bestTag && candidate.priority < best.priority) {
+			best, bestIndex = candidate, i
+		}
+	}
+	if bestIndex == -1 {
+		// Head was chosen, or every stream is in a dependency cycle.
+		return head
+	}
+	chosen := *best
+	heap.Remove(&q.frames, bestIndex)
+	heap.Push(&q.frames, head)
+	return chosen
+}
+
+// Whether the stream depends, directly or transitively, on another of
+// the streams. Chains are bounded, as the peer may create cycles.
+func (q *writeQueue) dependsOnAny(id StreamID, streams map[StreamID]int) bool {
+	for i := 0; i != len(q.priorities.order); i++ {
+		priority, ok := q.priorities.lookup(id)
+		if !ok || priority.StreamDependency == 0 {
+			return false
+		}
+		id = priority.StreamDependency
+		if _, ok := streams[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Weight of the stream's priority group, which dependent streams share.
+func (q *writeQueue) weight(id StreamID) int64 {
+	for i := 0; i <= len(q.priorities.order); i++ {
+		priority, ok := q.priorities.lookup(id)
+		if !ok {
+			break
+		} else if priority.StreamDependency == 0 {
+			return int64(priority.PriorityWeight) + 1
+		}
+		id = priority.StreamDependency
+	}
+	return kDefaultPriorityWeight
+}
+
+// Virtual time at which the stream's next DATA is due. Streams which
+// have fallen behind (or are new) are due now, and don't accrue credit.
+func (q *writeQueue) tag(id StreamID) int64 {
+	if tag := q.tags[id]; tag > q.virtualTime {
+		return tag
+	}
+	return q.virtualTime
+}
+
+// Charges DATA of n bytes written to the stream against its share.
+func (q *writeQueue) charge(id StreamID, n int) {
+	if q.tags == nil {
+		q.tags = make(map[StreamID]int64)
+	}
+	tag := q.tag(id)
+	q.virtualTime = tag
+	q.tags[id] = tag + int64(n)*256/q.weight(id)
+}
+
+// Forgets the scheduling state of a closed stream.
+func (q *writeQueue) retireStream(id StreamID) {
+	delete(q.tags, id)
+}
+
+// Whether no frames are queued or parked.
+func (q *writeQueue) empty() bool {
+	return len(q.frames) == 0 && len(q.parked) == 0
+}
+
+// Parks DATA and HEADERS of the stream until unstallStream().
+// Returns whether the stream wasn't already stalled.
+func (q *writeQueue) stallStream(id StreamID) bool {
+	if q.stalledStreams == nil {
+		q.stalledStreams = make(map[StreamID]bool)
+	}
+	stalled := q.stalledStreams[id]
+	q.stalledStreams[id] = true
+	return !stalled
+}
+
+// Re-queues parked frames of the stream, unless it's also
+// parked behind a stalled connection.
+func (q *writeQueue) unstallStream(id StreamID) {
+	delete(q.stalledStreams, id)
+	if !q.connectionStalled {
+		q.requeue(id)
+	}
+}
+
+// Parks all DATA until unstallConnection(). Returns whether
+// the connection wasn't already stalled.
+func (q *writeQueue) stallConnection() bool {
+	stalled := q.connectionStalled
+	q.connectionStalled = true
+	return !stalled
+}
+
+// Re-queues parked frames of streams which aren't themselves stalled.
+func (q *writeQueue) unstallConnection() {
+	q.connectionStalled = false
+	for id := range q.parked {
+		if !q.stalledStreams[id] {
+			q.requeue(id)
+		}
+	}
+}
+
+// Removes all queued and parked frames of the stream.
+func (q *writeQueue) dropStream(id StreamID) {
+	frames := q.frames[:0]
+	for _, queued := range q.frames {
+		if queued.frame.GetStreamID() != id {
+			frames = append(frames, queued)
+		}
+	}
+	q.frames = frames
+	heap.Init(&q.frames)
+
+	delete(q.parked, id)
+	delete(q.stalledStreams, id)
+	delete(q.tags, id)
+}
+
+// Records the peer's priority of the stream, which may be idle,
+// open, or closed.
+func (q *writeQueue) prioritize(id StreamID, priority FramePriority) {
+	q.priorities.set(id, priority)
+}
+
+// Frames retain their original priority when parked, so re-queued
+// frames resume in their original order.
+func (q *writeQueue) requeue(id StreamID) {
+	for _, queued := range q.parked[id] {
+		heap.Push(&q.frames, queued)
+	}
+	delete(q.parked, id)
+}
+
+func (q *writeQueue) mustPark(frame Frame) bool {
+	id := frame.GetStreamID()
+	switch frame.(type) {
+	case *DataFrame:
+		return q.connectionStalled || q.stalledStreams[id] ||
+			len(q.parked[id]) != 0
+	case *HeadersFrame:
+		// HEADERS (eg, trailers) may not overtake parked DATA.
+		return len(q.parked[id]) != 0
+	}
+	return false
+}
+
 // Functions for sort.Interface.
 func (h queuedFrameHeap) Len() int {
 	return len(h)